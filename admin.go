@@ -0,0 +1,56 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"time"
+)
+
+// the admin API is served on PPROF_PORT along with pprof and expvar
+
+func init() {
+	http.HandleFunc("/admin/backends", serveAdminBackends)
+}
+
+// backendStatus is a backend as reported by the admin API
+type backendStatus struct {
+	Addr      string     `json:"addr"`
+	Active    int        `json:"active"`
+	Breaker   string     `json:"breaker"`
+	Failures  int        `json:"failures"`
+	OpenUntil *time.Time `json:"open_until,omitempty"`
+}
+
+// status returns the state of every backend in use, ordered by address
+func (t *backendTable) status() []backendStatus {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	s := make([]backendStatus, 0, len(t.m))
+	for addr, b := range t.m {
+		st := backendStatus{
+			Addr:     addr,
+			Active:   b.active,
+			Breaker:  b.breaker.state.String(),
+			Failures: b.breaker.failures,
+		}
+		if b.breaker.state == breakerOpen {
+			until := b.breaker.until
+			st.OpenUntil = &until
+		}
+		s = append(s, st)
+	}
+	sort.Slice(s, func(i, j int) bool { return s[i].Addr < s[j].Addr })
+	return s
+}
+
+func serveAdminBackends(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, _backends.status())
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.Encode(v)
+}
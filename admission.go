@@ -0,0 +1,120 @@
+package main
+
+import (
+	"container/list"
+	"errors"
+	"expvar"
+	"sync"
+	"time"
+)
+
+var errServerBusy = errors.New("server busy")
+
+var (
+	// concurrent client handshakes, from accepting a connection until its
+	// backend address is decrypted
+	_handshakeGate = newAdmissionGate("handshake")
+	// concurrent backend dials
+	_dialGate = newAdmissionGate("dial")
+)
+
+// admissionGate lets at most limit holders in at once. Others wait in a
+// bounded FIFO queue for up to timeout, so a stampede is smoothed out
+// instead of hitting the backends all at once.
+type admissionGate struct {
+	name string
+
+	mu       sync.Mutex
+	limit    int
+	maxQueue int
+	timeout  time.Duration
+	active   int
+	queue    list.List
+}
+
+func newAdmissionGate(name string) *admissionGate {
+	g := &admissionGate{name: name}
+	_metrics.Set(name+"_active", expvar.Func(func() interface{} {
+		g.mu.Lock()
+		defer g.mu.Unlock()
+		return g.active
+	}))
+	_metrics.Set(name+"_queued", expvar.Func(func() interface{} {
+		g.mu.Lock()
+		defer g.mu.Unlock()
+		return g.queue.Len()
+	}))
+	return g
+}
+
+// configure sets the limit, 0 means unlimited
+func (g *admissionGate) configure(limit, maxQueue int, timeout time.Duration) {
+	g.mu.Lock()
+	g.limit, g.maxQueue, g.timeout = limit, maxQueue, timeout
+	g.mu.Unlock()
+}
+
+// acquire waits for a slot, it returns errServerBusy if the queue is full or
+// the wait timed out
+func (g *admissionGate) acquire() error {
+	g.mu.Lock()
+	if g.limit <= 0 {
+		g.active++
+		g.mu.Unlock()
+		return nil
+	}
+	if g.active < g.limit && g.queue.Len() == 0 {
+		g.active++
+		g.mu.Unlock()
+		return nil
+	}
+	if g.queue.Len() >= g.maxQueue || g.timeout <= 0 {
+		g.mu.Unlock()
+		countMetric(g.name + "_rejected")
+		return errServerBusy
+	}
+	ready := make(chan struct{})
+	e := g.queue.PushBack(ready)
+	timeout := g.timeout
+	g.mu.Unlock()
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case <-ready:
+		return nil
+	case <-timer.C:
+	}
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	select {
+	case <-ready:
+		// handed a slot just in time
+		return nil
+	default:
+	}
+	g.queue.Remove(e)
+	countMetric(g.name + "_timeout")
+	return errServerBusy
+}
+
+// release hands the slot over to the longest waiting one, if any
+func (g *admissionGate) release() {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if e := g.queue.Front(); e != nil {
+		g.queue.Remove(e)
+		close(e.Value.(chan struct{}))
+		return
+	}
+	g.active--
+}
+
+// releaser returns a function releasing the slot once, however often called
+func (g *admissionGate) releaser() func() {
+	var once sync.Once
+	return func() {
+		once.Do(g.release)
+	}
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestAdmissionGate(t *testing.T) {
+	g := newAdmissionGate("test")
+	g.configure(1, 2, time.Second)
+
+	if err := g.acquire(); err != nil {
+		t.Fatal(err)
+	}
+
+	// two waiters are queued in order, the third one is turned away
+	order := make(chan int, 2)
+	for i := 0; i < 2; i++ {
+		go func(i int) {
+			if err := g.acquire(); err != nil {
+				t.Error(err)
+				return
+			}
+			order <- i
+		}(i)
+		time.Sleep(time.Millisecond * 50)
+	}
+	if err := g.acquire(); err != errServerBusy {
+		t.Fatalf("expected busy, got %v", err)
+	}
+
+	g.release()
+	if i := <-order; i != 0 {
+		t.Fatalf("waiter %d admitted first", i)
+	}
+	g.release()
+	if i := <-order; i != 1 {
+		t.Fatalf("waiter %d admitted second", i)
+	}
+	g.release()
+
+	if g.active != 0 || g.queue.Len() != 0 {
+		t.Fatalf("gate not empty: %d %d", g.active, g.queue.Len())
+	}
+}
+
+func TestAdmissionGateTimeout(t *testing.T) {
+	g := newAdmissionGate("test_timeout")
+	g.configure(1, 1, time.Millisecond*50)
+
+	g.acquire()
+	start := time.Now()
+	if err := g.acquire(); err != errServerBusy {
+		t.Fatalf("expected busy, got %v", err)
+	}
+	if time.Since(start) < time.Millisecond*50 {
+		t.Fatal("gave up waiting too early")
+	}
+	if g.queue.Len() != 0 {
+		t.Fatal("timed out waiter still queued")
+	}
+	g.release()
+}
+
+func TestServerBusy(t *testing.T) {
+	_handshakeGate.configure(1, 0, 0)
+	defer _handshakeGate.configure(0, 0, 0)
+
+	b, err := encryptText(_echoServerAddr, _secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// an idle client takes no handshake slot
+	idle, err := net.Dial("tcp", _defaultFrontdAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer idle.Close()
+	time.Sleep(time.Millisecond * 100)
+	testProtocol(append(b, '\n'), nil)
+
+	// one in the middle of its handshake holds the only one
+	conn, err := net.Dial("tcp", _defaultFrontdAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.Write(b[:4])
+	time.Sleep(time.Millisecond * 100)
+	testProtocol(append(b, '\n'), []byte("4111"))
+
+	conn.Close()
+	time.Sleep(time.Millisecond * 100)
+	testProtocol(append(b, '\n'), nil)
+}
@@ -0,0 +1,233 @@
+package main
+
+import (
+	"errors"
+	"expvar"
+	"fmt"
+	"log"
+	"math"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	errBackendFull     = errors.New("backend concurrent connections exceeded")
+	errBackendDialRate = errors.New("backend dial rate exceeded")
+)
+
+// backendLimit caps the tunnels to one backend address, 0 means unlimited
+type backendLimit struct {
+	maxConns int
+	// dials per second, with bursts of the same size but at least one
+	dialRate float64
+}
+
+var (
+	_defaultBackendLimit backendLimit
+	// per address overrides of _defaultBackendLimit
+	_backendLimits = map[string]backendLimit{}
+
+	// backends of the listening ports, set up from the above by main
+	_backends = newBackendTable(backendLimit{}, nil, breakerConfig{_BreakerFailures, _BreakerCooldown, _BreakerProbes})
+)
+
+// backendState is what frontd keeps track of for a backend address
+type backendState struct {
+	addr    string
+	active  int
+	dials   tokenBucket
+	breaker circuitBreaker
+}
+
+// backendTable holds the state of every backend address in use, and the
+// limits and circuit breaker settings they are held to
+type backendTable struct {
+	defaultLimit backendLimit
+	// per address overrides of defaultLimit
+	limits  map[string]backendLimit
+	breaker breakerConfig
+
+	mu sync.Mutex
+	m  map[string]*backendState
+}
+
+func newBackendTable(defaultLimit backendLimit, limits map[string]backendLimit, breaker breakerConfig) *backendTable {
+	return &backendTable{
+		defaultLimit: defaultLimit,
+		limits:       limits,
+		breaker:      breaker,
+		m:            make(map[string]*backendState),
+	}
+}
+
+func init() {
+	_metrics.Set("backend_active", expvar.Func(func() interface{} {
+		return _backends.activeConns()
+	}))
+}
+
+func (t *backendTable) limitOf(addr string) backendLimit {
+	if l, ok := t.limits[addr]; ok {
+		return l
+	}
+	return t.defaultLimit
+}
+
+// dialBurst is the burst of dials allowed, as large as the rate but at least
+// one, so a rate below one per second still lets dials through
+func (l backendLimit) dialBurst() float64 {
+	return math.Max(l.dialRate, 1)
+}
+
+// admit takes a slot for a new tunnel to addr, the backend is to be dialed
+// only if no error is returned
+func (t *backendTable) admit(addr string, now time.Time) (*backendSlot, error) {
+	limit := t.limitOf(addr)
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	b, ok := t.m[addr]
+	if !ok {
+		b = &backendState{addr: addr}
+		t.m[addr] = b
+	}
+
+	if limit.maxConns > 0 && b.active >= limit.maxConns {
+		countMetric("backend_rejected_conns")
+		return nil, errBackendFull
+	}
+	probe, ok := b.breaker.allow(now, t.breaker)
+	if !ok {
+		countMetric("breaker_rejected")
+		return nil, errBreakerOpen
+	}
+	if limit.dialRate > 0 && !b.dials.take(now, limit.dialRate, limit.dialBurst()) {
+		b.breaker.cancel(probe)
+		countMetric("backend_rejected_dial_rate")
+		return nil, errBackendDialRate
+	}
+
+	b.active++
+	return &backendSlot{t: t, b: b, probe: probe}, nil
+}
+
+// backendSlot is a tunnel admitted to a backend
+type backendSlot struct {
+	t     *backendTable
+	b     *backendState
+	probe bool
+	once  sync.Once
+}
+
+// dialed reports the outcome of dialing the backend to its circuit breaker
+func (s *backendSlot) dialed(err error, now time.Time) {
+	s.t.mu.Lock()
+	defer s.t.mu.Unlock()
+	probe := s.probe
+	s.probe = false
+	if s.b.breaker.report(probe, err == nil, now, s.t.breaker) {
+		countMetric("breaker_opened")
+		log.Println("circuit breaker open:", s.b.addr, err)
+	}
+}
+
+// done gives the slot back, however often called. A probe never dialed is
+// given back to the breaker as well.
+func (s *backendSlot) done() {
+	s.once.Do(func() {
+		s.t.mu.Lock()
+		s.b.active--
+		s.b.breaker.cancel(s.probe)
+		s.probe = false
+		s.t.mu.Unlock()
+	})
+}
+
+// activeConns returns the number of tunnels to every backend in use
+func (t *backendTable) activeConns() map[string]int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	m := make(map[string]int, len(t.m))
+	for addr, b := range t.m {
+		if b.active > 0 {
+			m[addr] = b.active
+		}
+	}
+	return m
+}
+
+// sweep forgets backends without tunnels whose dial rate is back to full and
+// whose breaker is not cooling down
+func (t *backendTable) sweep(now time.Time) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for addr, b := range t.m {
+		limit := t.limitOf(addr)
+		if b.active == 0 && (limit.dialRate <= 0 || b.dials.full(now, limit.dialRate, limit.dialBurst())) &&
+			!b.breaker.coolingDown(now) {
+			delete(t.m, addr)
+		}
+	}
+}
+
+func sweepBackends(t *backendTable) {
+	for range time.Tick(_limiterSweepEvery) {
+		t.sweep(time.Now())
+	}
+}
+
+// backendConn gives the backend slot back when closed
+type backendConn struct {
+	net.Conn
+	done func()
+}
+
+func (c *backendConn) Close() error {
+	c.done()
+	return c.Conn.Close()
+}
+
+// parseBackendLimit parses "maxconns/dialrate", either part may be empty
+func parseBackendLimit(s string) (backendLimit, error) {
+	var l backendLimit
+	parts := strings.SplitN(s, "/", 2)
+	if len(parts[0]) > 0 {
+		n, err := strconv.Atoi(parts[0])
+		if err != nil || n < 0 {
+			return l, fmt.Errorf("invalid backend connection limit %q", s)
+		}
+		l.maxConns = n
+	}
+	if len(parts) > 1 && len(parts[1]) > 0 {
+		r, err := strconv.ParseFloat(parts[1], 64)
+		if err != nil || r < 0 {
+			return l, fmt.Errorf("invalid backend dial rate %q", s)
+		}
+		l.dialRate = r
+	}
+	return l, nil
+}
+
+// parseBackendLimits parses "addr=maxconns/dialrate,..." of BACKEND_LIMITS
+func parseBackendLimits(s string) (map[string]backendLimit, error) {
+	m := make(map[string]backendLimit)
+	for _, e := range strings.Split(s, ",") {
+		e = strings.TrimSpace(e)
+		if len(e) == 0 {
+			continue
+		}
+		i := strings.LastIndex(e, "=")
+		if i <= 0 {
+			return nil, fmt.Errorf("invalid backend limit %q", e)
+		}
+		l, err := parseBackendLimit(e[i+1:])
+		if err != nil {
+			return nil, err
+		}
+		m[e[:i]] = l
+	}
+	return m, nil
+}
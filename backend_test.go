@@ -0,0 +1,107 @@
+package main
+
+import (
+	"io/ioutil"
+	"testing"
+	"time"
+)
+
+func TestParseBackendLimits(t *testing.T) {
+	m, err := parseBackendLimits("10.0.0.1:9000=100/20, [::1]:9000=/5,10.0.0.2:9000=50")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for addr, l := range map[string]backendLimit{
+		"10.0.0.1:9000": {100, 20},
+		"[::1]:9000":    {0, 5},
+		"10.0.0.2:9000": {50, 0},
+	} {
+		if m[addr] != l {
+			t.Errorf("%s: %+v, expected %+v", addr, m[addr], l)
+		}
+	}
+
+	for _, s := range []string{"10.0.0.1:9000", "=1/1", "a=x", "a=1/x", "a=-1"} {
+		if _, err := parseBackendLimits(s); err == nil {
+			t.Errorf("%q should not parse", s)
+		}
+	}
+}
+
+func TestBackendDialRate(t *testing.T) {
+	tbl := newBackendTable(backendLimit{dialRate: 2}, nil, breakerConfig{})
+	now := time.Now()
+	for i := 0; i < 2; i++ {
+		s, err := tbl.admit("a", now)
+		if err != nil {
+			t.Fatal(err)
+		}
+		s.done()
+	}
+	if _, err := tbl.admit("a", now); err != errBackendDialRate {
+		t.Fatalf("expected dial rate limit, got %v", err)
+	}
+	if _, err := tbl.admit("b", now); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tbl.admit("a", now.Add(time.Second)); err != nil {
+		t.Fatal(err)
+	}
+
+	tbl.sweep(now.Add(time.Hour))
+	if _, ok := tbl.m["a"]; !ok {
+		t.Fatal("backend with a tunnel swept")
+	}
+}
+
+func TestBackendFractionalDialRate(t *testing.T) {
+	tbl := newBackendTable(backendLimit{dialRate: 0.5}, nil, breakerConfig{})
+	now := time.Now()
+	s, err := tbl.admit("a", now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.done()
+	if _, err := tbl.admit("a", now.Add(time.Second)); err != errBackendDialRate {
+		t.Fatalf("expected dial rate limit, got %v", err)
+	}
+	// one dial every two seconds
+	s, err = tbl.admit("a", now.Add(time.Second*2))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.done()
+}
+
+func TestBackendMaxConns(t *testing.T) {
+	tbl := newBackendTable(backendLimit{}, map[string]backendLimit{string(_echoServerAddr): {maxConns: 1}}, breakerConfig{})
+	frontd, stop := startListener(t, &listener{backends: tbl})
+	defer stop()
+
+	b, err := encryptText(_echoServerAddr, _secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn := dialListener(t, frontd)
+	conn.Write(append(b, '\n'))
+	testEchoRound(conn)
+
+	other := dialListener(t, frontd)
+	other.Write(append(b, '\n'))
+	if got, _ := ioutil.ReadAll(other); string(got) != "4112" {
+		t.Fatalf("expected 4112, got %q", got)
+	}
+	other.Close()
+	if n := tbl.activeConns()[string(_echoServerAddr)]; n != 1 {
+		t.Fatalf("%d active tunnels, expected 1", n)
+	}
+	// other listeners keep their own limits
+	testProtocol(append(b, '\n'), nil)
+
+	conn.Close()
+	time.Sleep(time.Millisecond * 100)
+	conn = dialListener(t, frontd)
+	defer conn.Close()
+	conn.Write(append(b, '\n'))
+	testEchoRound(conn)
+}
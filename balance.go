@@ -0,0 +1,237 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"log"
+	"math/rand"
+	"net"
+	"net/url"
+	"sort"
+	"strings"
+	"sync/atomic"
+)
+
+// lbStrategy decides the order in which the backends of a target are tried
+type lbStrategy int
+
+const (
+	lbRoundRobin lbStrategy = iota
+	lbRandom
+	lbLeastConn
+	lbHash
+	// in the order given, e.g. by SRV priority
+	lbFirst
+)
+
+var _lbStrategies = map[string]lbStrategy{
+	"rr":        lbRoundRobin,
+	"random":    lbRandom,
+	"leastconn": lbLeastConn,
+	"hash":      lbHash,
+	"first":     lbFirst,
+}
+
+// strategies of schemes whose resolver orders the addresses itself
+var _schemeStrategies = map[string]lbStrategy{
+	"srv": lbFirst,
+}
+
+var errNoBackend = errors.New("no backend address")
+
+// round-robin positions, targets share them by the hash of their plaintext
+var _rrCounters [256]uint32
+
+// a resolver looks up the backend addresses of a name, by the scheme of the
+// target
+var _resolvers = map[string]func(name string) ([]string, error){}
+
+// backendTarget is what a cipher address decrypts to: either one backend
+// address, a list of them or a name to be resolved, with an optional
+// strategy, e.g. "10.0.0.1:9000,10.0.0.2:9000?lb=leastconn" or
+// "consul://zone-3-gate?lb=hash"
+type backendTarget struct {
+	// empty for a list of addresses
+	scheme string
+	name   string
+
+	addrs    []string
+	strategy lbStrategy
+	// the plaintext
+	key string
+}
+
+// isMultiTarget tells a plain backend address from a target to be parsed or
+// resolved
+func isMultiTarget(s string) bool {
+	return strings.ContainsAny(s, ",?") || strings.Contains(s, "://") || isHostName(s)
+}
+
+func parseBackendTarget(s string) (*backendTarget, error) {
+	t := &backendTarget{key: s}
+	if i := strings.Index(s, "://"); i >= 0 {
+		t.strategy = _schemeStrategies[s[:i]]
+	}
+	if i := strings.IndexByte(s, '?'); i >= 0 {
+		q, err := url.ParseQuery(s[i+1:])
+		if err != nil {
+			return nil, err
+		}
+		if name := q.Get("lb"); len(name) > 0 {
+			lb, ok := _lbStrategies[name]
+			if !ok {
+				return nil, fmt.Errorf("unknown balancing strategy %q", name)
+			}
+			t.strategy = lb
+		}
+		s = s[:i]
+	}
+	if i := strings.Index(s, "://"); i >= 0 {
+		t.scheme, t.name = s[:i], s[i+3:]
+		if _, ok := _resolvers[t.scheme]; !ok {
+			return nil, fmt.Errorf("unknown backend scheme %q", t.scheme)
+		}
+		if len(t.name) == 0 {
+			return nil, errNoBackend
+		}
+		return t, nil
+	}
+	for _, addr := range strings.Split(s, ",") {
+		addr = strings.TrimSpace(addr)
+		if len(addr) > 0 {
+			t.addrs = append(t.addrs, addr)
+		}
+	}
+	if len(t.addrs) == 0 {
+		return nil, errNoBackend
+	}
+	return t, nil
+}
+
+func hashString(s ...string) uint64 {
+	h := fnv.New64a()
+	for _, e := range s {
+		h.Write([]byte(e))
+	}
+	return h.Sum64()
+}
+
+// resolve returns the backend addresses of the target, host names are
+// resolved as well
+func (t *backendTarget) resolve() ([]string, error) {
+	addrs := t.addrs
+	if len(t.scheme) > 0 {
+		var err error
+		addrs, err = _resolvers[t.scheme](t.name)
+		if err != nil {
+			return nil, err
+		}
+	}
+	addrs, err := expandHosts(addrs)
+	if err == nil && len(addrs) == 0 {
+		err = errNoBackend
+	}
+	return addrs, err
+}
+
+// order returns the backend addresses in the order to be tried, client is
+// the IP address of the client and backends counts their tunnels
+func (t *backendTarget) order(candidates []string, client string, backends *backendTable) []string {
+	addrs := make([]string, len(candidates))
+	n := len(addrs)
+	switch t.strategy {
+	case lbRoundRobin, lbRandom, lbLeastConn:
+		var start int
+		if t.strategy == lbRoundRobin {
+			start = int(atomic.AddUint32(&_rrCounters[hashString(t.key)%uint64(len(_rrCounters))], 1) % uint32(n))
+		} else {
+			start = rand.Intn(n)
+		}
+		for i := range addrs {
+			addrs[i] = candidates[(start+i)%n]
+		}
+		if t.strategy == lbLeastConn {
+			// ties keep the random rotation, or the first backend would get
+			// them all
+			active := backends.activeConns()
+			sort.SliceStable(addrs, func(i, j int) bool {
+				return active[addrs[i]] < active[addrs[j]]
+			})
+		}
+	case lbFirst:
+		copy(addrs, candidates)
+	case lbHash:
+		// rendezvous hashing: a client keeps its backend as long as that one
+		// is listed, and only the clients of a removed backend move
+		copy(addrs, candidates)
+		scores := make(map[string]uint64, n)
+		for _, addr := range addrs {
+			scores[addr] = hashString(client, "|", addr)
+		}
+		sort.SliceStable(addrs, func(i, j int) bool {
+			return scores[addrs[i]] > scores[addrs[j]]
+		})
+	}
+	return addrs
+}
+
+// mapTarget applies the rewrite map, the canaries and the route table to a
+// decrypted target, client is the IP address of the client
+func mapTarget(s, client string) string {
+	return routeTarget(canaryTarget(rewriteTarget(s), client))
+}
+
+// dialTarget dials the healthy backends of a decrypted target or route ID in
+// the order of its strategy, failing over to the next one when a dial fails
+// or the backend is at capacity. client is the IP address of the client.
+func (t *backendTable) dialTarget(target, client string) (net.Conn, []byte, error) {
+	return t.dialBackends(mapTarget(target, client), client)
+}
+
+// dialBackends is dialTarget for a target already mapped
+func (t *backendTable) dialBackends(target, client string) (net.Conn, []byte, error) {
+	if !isMultiTarget(target) {
+		if len(dropRevoked([]string{target})) == 0 {
+			return nil, []byte("4114"), errRevoked
+		}
+		return t.dialBackend(target)
+	}
+	tgt, err := parseBackendTarget(target)
+	if err != nil {
+		return nil, []byte("4102"), err
+	}
+
+	// host names are checked before and their addresses after resolving
+	if tgt.addrs = dropRevoked(tgt.addrs); len(tgt.addrs) == 0 && len(tgt.scheme) == 0 {
+		return nil, []byte("4114"), errRevoked
+	}
+	candidates, err := tgt.resolve()
+	if err != nil {
+		return nil, []byte("4102"), err
+	}
+	if candidates = dropRevoked(candidates); len(candidates) == 0 {
+		return nil, []byte("4114"), errRevoked
+	}
+	if candidates = _health.filterHealthy(candidates); len(candidates) == 0 {
+		countMetric("health_rejected")
+		return nil, []byte("4102"), errUnhealthy
+	}
+
+	var errCode []byte
+	for i, addr := range tgt.order(candidates, client, t) {
+		if i > 0 {
+			countMetric("backend_failover")
+		}
+		var backend net.Conn
+		backend, errCode, err = t.dialBackend(addr)
+		if err == nil {
+			return backend, nil, nil
+		}
+		if err == errServerBusy {
+			break
+		}
+		log.Println(addr, err)
+	}
+	return nil, errCode, err
+}
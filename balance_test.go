@@ -0,0 +1,123 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/net/http2"
+)
+
+func TestParseBackendTarget(t *testing.T) {
+	tg, err := parseBackendTarget("10.0.0.1:9000, [::1]:9000,?lb=leastconn")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(tg.addrs, []string{"10.0.0.1:9000", "[::1]:9000"}) || tg.strategy != lbLeastConn {
+		t.Fatalf("unexpected target %+v", tg)
+	}
+
+	for _, s := range []string{",", "?lb=rr", "10.0.0.1:9000?lb=x", "10.0.0.1:9000?%zz"} {
+		if _, err := parseBackendTarget(s); err == nil {
+			t.Errorf("%q should not parse", s)
+		}
+	}
+}
+
+func TestBackendTargetOrder(t *testing.T) {
+	tbl := newBackendTable(backendLimit{}, nil, breakerConfig{})
+	tg, _ := parseBackendTarget("a,b,c")
+	seen := make(map[string]int)
+	for i := 0; i < 30; i++ {
+		addrs := tg.order(tg.addrs, "", tbl)
+		if len(addrs) != 3 {
+			t.Fatalf("candidates missing: %v", addrs)
+		}
+		seen[addrs[0]]++
+	}
+	for _, addr := range tg.addrs {
+		if seen[addr] != 10 {
+			t.Fatalf("round-robin uneven: %v", seen)
+		}
+	}
+
+	// a client sticks to its backend, only the clients of a removed one move
+	tg, _ = parseBackendTarget("a,b,c?lb=hash")
+	moved := 0
+	for _, ip := range []string{"10.0.0.1", "10.0.0.2", "10.0.0.3", "10.0.0.4", "10.0.0.5", "10.0.0.6"} {
+		first := tg.order(tg.addrs, ip, tbl)[0]
+		if tg.order(tg.addrs, ip, tbl)[0] != first {
+			t.Fatalf("%s moved between calls", ip)
+		}
+		rest := &backendTarget{strategy: lbHash}
+		for _, addr := range tg.addrs {
+			if addr != "c" {
+				rest.addrs = append(rest.addrs, addr)
+			}
+		}
+		if first != "c" && rest.order(rest.addrs, ip, tbl)[0] != first {
+			moved++
+		}
+	}
+	if moved > 0 {
+		t.Fatalf("%d clients moved", moved)
+	}
+
+	s, err := tbl.admit("a", time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.done()
+	tg, _ = parseBackendTarget("a,b?lb=leastconn")
+	for i := 0; i < 10; i++ {
+		if addrs := tg.order(tg.addrs, "", tbl); addrs[0] != "b" {
+			t.Fatalf("busier backend first: %v", addrs)
+		}
+	}
+}
+
+func TestBackendFailover(t *testing.T) {
+	// nothing listens on the first one
+	target := "127.0.0.1:62868," + string(_echoServerAddr)
+	for _, lb := range []string{"rr", "random", "leastconn", "hash"} {
+		b, err := encryptText([]byte(target+"?lb="+lb), _secret)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i < 2; i++ {
+			conn, err := net.Dial("tcp", _defaultFrontdAddr)
+			if err != nil {
+				t.Fatal(err)
+			}
+			conn.Write(append(b, '\n'))
+			testEchoRound(conn)
+			conn.Close()
+		}
+	}
+}
+
+func TestHTTP2Failover(t *testing.T) {
+	a, _ := newTestBackend("A")
+	defer a.Close()
+	cipherAddr, err := encryptText([]byte("127.0.0.1:62868,"+strings.TrimPrefix(a.URL, "http://")), _secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tr := &http2.Transport{
+		AllowHTTP: true,
+		DialTLSContext: func(ctx context.Context, network, addr string, cfg *tls.Config) (net.Conn, error) {
+			return net.Dial(network, addr)
+		},
+	}
+	defer tr.CloseIdleConnections()
+	client := &http.Client{Transport: tr, Timeout: time.Second * 5}
+	for i := 0; i < 3; i++ {
+		testHTTPGet(t, client, "http://"+_defaultFrontdAddr+"/", string(cipherAddr), http.StatusOK, "A|127.0.0.1|")
+	}
+}
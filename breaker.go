@@ -0,0 +1,131 @@
+package main
+
+import (
+	"errors"
+	"expvar"
+	"time"
+)
+
+var errBreakerOpen = errors.New("backend circuit breaker open")
+
+var (
+	// consecutive dial failures opening the breaker of a backend, 0 disables
+	// the breaker
+	_BreakerFailures int
+	// how long an open breaker fails dials fast
+	_BreakerCooldown = time.Second * 10
+	// concurrent probe dials let through a half-open breaker
+	_BreakerProbes = 1
+)
+
+// breakerConfig is how the circuit breakers of a backendTable trip, as
+// _BreakerFailures, _BreakerCooldown and _BreakerProbes do by default
+type breakerConfig struct {
+	failures int
+	cooldown time.Duration
+	probes   int
+}
+
+type breakerState int
+
+const (
+	breakerClosed breakerState = iota
+	breakerOpen
+	breakerHalfOpen
+)
+
+func (s breakerState) String() string {
+	switch s {
+	case breakerOpen:
+		return "open"
+	case breakerHalfOpen:
+		return "half-open"
+	}
+	return "closed"
+}
+
+// circuitBreaker stops dialing a backend after breakerConfig.failures dials
+// failed in a row. Once the cool-down is over it is half-open: up to
+// breakerConfig.probes dials go through, the first success closes it again
+// and a failure opens it for another cool-down. It is guarded by the
+// backendTable lock.
+type circuitBreaker struct {
+	state    breakerState
+	failures int
+	// end of the cool-down
+	until time.Time
+	// probes in flight
+	probes int
+}
+
+func init() {
+	_metrics.Set("breaker_state", expvar.Func(func() interface{} {
+		return _backends.breakerStates()
+	}))
+}
+
+// allow reports whether a dial may go ahead and whether it is a probe
+func (cb *circuitBreaker) allow(now time.Time, cfg breakerConfig) (probe bool, ok bool) {
+	switch cb.state {
+	case breakerOpen:
+		if now.Before(cb.until) {
+			return false, false
+		}
+		cb.state = breakerHalfOpen
+		cb.probes = 0
+		fallthrough
+	case breakerHalfOpen:
+		if cb.probes >= cfg.probes {
+			return false, false
+		}
+		cb.probes++
+		return true, true
+	}
+	return false, true
+}
+
+// cancel gives back a probe that was never dialed
+func (cb *circuitBreaker) cancel(probe bool) {
+	if probe && cb.probes > 0 {
+		cb.probes--
+	}
+}
+
+// report records the outcome of a dial, it returns true if that opened the
+// breaker
+func (cb *circuitBreaker) report(probe, ok bool, now time.Time, cfg breakerConfig) bool {
+	cb.cancel(probe)
+	if ok {
+		cb.state = breakerClosed
+		cb.failures = 0
+		return false
+	}
+	if cfg.failures <= 0 {
+		return false
+	}
+	cb.failures++
+	if cb.state == breakerOpen || (!probe && cb.failures < cfg.failures) {
+		return false
+	}
+	cb.state = breakerOpen
+	cb.until = now.Add(cfg.cooldown)
+	return true
+}
+
+// coolingDown reports whether the breaker still fails dials fast
+func (cb *circuitBreaker) coolingDown(now time.Time) bool {
+	return cb.state == breakerOpen && now.Before(cb.until)
+}
+
+// breakerStates returns the backends whose breaker is not closed
+func (t *backendTable) breakerStates() map[string]string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	m := make(map[string]string)
+	for addr, b := range t.m {
+		if b.breaker.state != breakerClosed {
+			m[addr] = b.breaker.state.String()
+		}
+	}
+	return m
+}
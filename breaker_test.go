@@ -0,0 +1,132 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestCircuitBreaker(t *testing.T) {
+	tbl := newBackendTable(backendLimit{}, nil, breakerConfig{2, time.Second, 1})
+	now := time.Now()
+	fail := func(now time.Time) {
+		s, err := tbl.admit("a", now)
+		if err != nil {
+			t.Fatal(err)
+		}
+		s.dialed(errBreakerOpen, now)
+		s.done()
+	}
+
+	fail(now)
+	fail(now)
+	if _, err := tbl.admit("a", now); err != errBreakerOpen {
+		t.Fatalf("expected open breaker, got %v", err)
+	}
+	tbl.sweep(now)
+	if _, ok := tbl.m["a"]; !ok {
+		t.Fatal("open breaker swept")
+	}
+
+	// half-open after the cool-down, a single probe is let through
+	now = now.Add(time.Second)
+	probe, err := tbl.admit("a", now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tbl.admit("a", now); err != errBreakerOpen {
+		t.Fatalf("expected a single probe, got %v", err)
+	}
+	if st := tbl.breakerStates()["a"]; st != "half-open" {
+		t.Fatalf("breaker %q, expected half-open", st)
+	}
+
+	// a failed probe opens it again
+	probe.dialed(errBreakerOpen, now)
+	probe.done()
+	if _, err := tbl.admit("a", now); err != errBreakerOpen {
+		t.Fatalf("expected open breaker, got %v", err)
+	}
+
+	// a probe never dialed is given back, a successful one closes the breaker
+	now = now.Add(time.Second)
+	probe, _ = tbl.admit("a", now)
+	probe.done()
+	probe, err = tbl.admit("a", now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	probe.dialed(nil, now)
+	if _, err := tbl.admit("a", now); err != nil {
+		t.Fatal(err)
+	}
+	if len(tbl.breakerStates()) != 0 {
+		t.Fatal("breaker not closed")
+	}
+}
+
+func TestCircuitBreakerFailFast(t *testing.T) {
+	tbl := newBackendTable(backendLimit{}, nil, breakerConfig{2, time.Second * 10, 1})
+	frontd, stop := startListener(t, &listener{backends: tbl})
+	defer stop()
+	reply := func(b []byte) string {
+		conn := dialListener(t, frontd)
+		defer conn.Close()
+		conn.Write(b)
+		got, _ := ioutil.ReadAll(conn)
+		return string(got)
+	}
+
+	// nothing listens there
+	addr := []byte("127.0.0.1:62867")
+	b, err := encryptText(addr, _secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		if got := reply(append(b, '\n')); got != "4102" {
+			t.Fatalf("expected 4102, got %q", got)
+		}
+	}
+
+	rejected := metricValue("breaker_rejected")
+	if got := reply(append(b, '\n')); got != "4102" {
+		t.Fatalf("expected 4102, got %q", got)
+	}
+	if metricValue("breaker_rejected") != rejected+1 {
+		t.Fatal("dial not failed fast")
+	}
+
+	var found bool
+	for _, s := range tbl.status() {
+		if s.Addr == string(addr) {
+			found = true
+			if s.Breaker != "open" || s.Failures != 2 || s.OpenUntil == nil {
+				t.Fatalf("unexpected status %+v", s)
+			}
+		}
+	}
+	if !found {
+		t.Fatal("backend missing from the status")
+	}
+	w := httptest.NewRecorder()
+	serveAdminBackends(w, httptest.NewRequest("GET", "/admin/backends", nil))
+	var admin []backendStatus
+	if err := json.Unmarshal(w.Body.Bytes(), &admin); err != nil {
+		t.Fatal(err)
+	}
+	for _, s := range admin {
+		if s.Addr == string(addr) {
+			t.Fatalf("backend of another listener in the admin API %+v", s)
+		}
+	}
+
+	// the echo backend is not affected
+	c := dialListener(t, frontd)
+	defer c.Close()
+	b, _ = encryptText(_echoServerAddr, _secret)
+	c.Write(append(b, '\n'))
+	testEchoRound(c)
+}
@@ -0,0 +1,241 @@
+package main
+
+import (
+	"expvar"
+	"sync"
+	"sync/atomic"
+	"time"
+	"unsafe"
+)
+
+const _addrCacheShards = 64
+
+var (
+	// decrypted backend addresses by cipher text
+	_addrCache = newAddrCache(_MaxBackendAddrCacheCount, time.Hour)
+
+	// marks a removed entry, lookups probe past it
+	_tombstone = &cacheEntry{}
+)
+
+func init() {
+	_metrics.Set("addr_cache_entries", expvar.Func(func() interface{} {
+		return _addrCache.len()
+	}))
+}
+
+type cacheEntry struct {
+	key string
+	val []byte
+	// unix nanoseconds, 0 never expires
+	expires int64
+	// set when read, cleared by the CLOCK hand
+	ref uint32
+	// position in the ring and the index of its shard, only used with the
+	// shard locked
+	ring, slot int
+}
+
+// cacheIndex is an open addressing hash table of *cacheEntry, read without
+// locks. Slots only ever change from nil to an entry and from an entry to
+// _tombstone, a new index is published to get rid of tombstones or grow.
+type cacheIndex struct {
+	slots []unsafe.Pointer
+	// slots taken by entries and tombstones
+	used int
+}
+
+// addrCache is a bounded cache of decrypted backend addresses. Reads are
+// lock free, writes lock one of its shards. When a shard is full, the CLOCK
+// algorithm evicts an entry which has not been read since the hand last
+// passed it, an approximation of LRU.
+type addrCache struct {
+	shards [_addrCacheShards]cacheShard
+	ttl    time.Duration
+}
+
+type cacheShard struct {
+	index unsafe.Pointer // *cacheIndex
+
+	mu   sync.Mutex
+	ring []*cacheEntry
+	hand int
+	max  int
+}
+
+func newAddrCache(size int, ttl time.Duration) *addrCache {
+	c := &addrCache{}
+	c.configure(size, ttl)
+	return c
+}
+
+// configure empties the cache and sets its size and TTL, 0 means no expiry.
+// It is not safe to call while the cache is in use.
+func (c *addrCache) configure(size int, ttl time.Duration) {
+	c.ttl = ttl
+	for i := range c.shards {
+		s := &c.shards[i]
+		s.max = (size + _addrCacheShards - 1) / _addrCacheShards
+		s.ring = nil
+		s.hand = 0
+		atomic.StorePointer(&s.index, unsafe.Pointer(&cacheIndex{slots: make([]unsafe.Pointer, 16)}))
+	}
+}
+
+// cacheHash is FNV-1a, without the allocations of hash/fnv
+func cacheHash(key []byte) uint64 {
+	h := uint64(14695981039346656037)
+	for _, b := range key {
+		h ^= uint64(b)
+		h *= 1099511628211
+	}
+	return h
+}
+
+func cacheHashString(key string) uint64 {
+	h := uint64(14695981039346656037)
+	for i := 0; i < len(key); i++ {
+		h ^= uint64(key[i])
+		h *= 1099511628211
+	}
+	return h
+}
+
+func (c *addrCache) shard(h uint64) *cacheShard {
+	return &c.shards[h%_addrCacheShards]
+}
+
+// get returns the cached value of key, the value must not be modified
+func (c *addrCache) get(key []byte) ([]byte, bool) {
+	h := cacheHash(key)
+	idx := (*cacheIndex)(atomic.LoadPointer(&c.shard(h).index))
+	mask := uint64(len(idx.slots) - 1)
+	for i := (h / _addrCacheShards) & mask; ; i = (i + 1) & mask {
+		e := (*cacheEntry)(atomic.LoadPointer(&idx.slots[i]))
+		if e == nil {
+			return nil, false
+		}
+		if e == _tombstone || e.key != string(key) {
+			continue
+		}
+		if e.expires > 0 && time.Now().UnixNano() > e.expires {
+			return nil, false
+		}
+		if atomic.LoadUint32(&e.ref) == 0 {
+			atomic.StoreUint32(&e.ref, 1)
+		}
+		return e.val, true
+	}
+}
+
+// set caches val for key
+func (c *addrCache) set(key string, val []byte) {
+	h := cacheHashString(key)
+	s := c.shard(h)
+	e := &cacheEntry{key: key, val: val}
+	if c.ttl > 0 {
+		e.expires = time.Now().Add(c.ttl).UnixNano()
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	idx := (*cacheIndex)(s.index)
+	if old := idx.find(key, h); old != nil {
+		// replaced, e.g. an expired one
+		s.ring[old.ring] = e
+		e.ring = old.ring
+		s.remove(old)
+	} else if len(s.ring) < s.max {
+		e.ring = len(s.ring)
+		s.ring = append(s.ring, e)
+	} else {
+		e.ring = s.evict()
+		s.ring[e.ring] = e
+	}
+
+	idx = (*cacheIndex)(s.index)
+	if (idx.used+1)*4 > len(idx.slots)*3 {
+		// e is in the ring already
+		s.rebuild()
+		return
+	}
+	idx.insert(e, h)
+}
+
+// find returns the entry of key, locked
+func (idx *cacheIndex) find(key string, h uint64) *cacheEntry {
+	mask := uint64(len(idx.slots) - 1)
+	for i := (h / _addrCacheShards) & mask; ; i = (i + 1) & mask {
+		e := (*cacheEntry)(idx.slots[i])
+		if e == nil {
+			return nil
+		}
+		if e != _tombstone && e.key == key {
+			return e
+		}
+	}
+}
+
+// insert publishes e in the first free slot, locked
+func (idx *cacheIndex) insert(e *cacheEntry, h uint64) {
+	mask := uint64(len(idx.slots) - 1)
+	for i := (h / _addrCacheShards) & mask; ; i = (i + 1) & mask {
+		if idx.slots[i] == nil {
+			e.slot = int(i)
+			idx.used++
+			atomic.StorePointer(&idx.slots[i], unsafe.Pointer(e))
+			return
+		}
+	}
+}
+
+// remove replaces an entry by a tombstone, locked
+func (s *cacheShard) remove(e *cacheEntry) {
+	idx := (*cacheIndex)(s.index)
+	atomic.StorePointer(&idx.slots[e.slot], unsafe.Pointer(_tombstone))
+}
+
+// evict moves the CLOCK hand to an expired entry or one not read since the
+// hand passed it last, removes it and returns its position in the ring
+func (s *cacheShard) evict() int {
+	now := time.Now().UnixNano()
+	for {
+		i := s.hand
+		s.hand = (s.hand + 1) % len(s.ring)
+		e := s.ring[i]
+		if atomic.LoadUint32(&e.ref) == 1 && (e.expires == 0 || now <= e.expires) {
+			atomic.StoreUint32(&e.ref, 0)
+			continue
+		}
+		s.remove(e)
+		countMetric("addr_cache_evictions")
+		return i
+	}
+}
+
+// rebuild publishes a new index of the entries in the ring without
+// tombstones, sized for them to take at most half of it. Readers of the old
+// one are not disturbed.
+func (s *cacheShard) rebuild() {
+	n := 16
+	for n < (len(s.ring)+1)*2 {
+		n *= 2
+	}
+	idx := &cacheIndex{slots: make([]unsafe.Pointer, n)}
+	for _, e := range s.ring {
+		idx.insert(e, cacheHashString(e.key))
+	}
+	atomic.StorePointer(&s.index, unsafe.Pointer(idx))
+}
+
+// len returns the number of entries, expired ones included
+func (c *addrCache) len() int {
+	n := 0
+	for i := range c.shards {
+		s := &c.shards[i]
+		s.mu.Lock()
+		n += len(s.ring)
+		s.mu.Unlock()
+	}
+	return n
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestAddrCache(t *testing.T) {
+	c := newAddrCache(_addrCacheShards*100, 0)
+	for i := 0; i < 10000; i++ {
+		c.set(strconv.Itoa(i), []byte("addr"+strconv.Itoa(i)))
+	}
+	if n := c.len(); n != _addrCacheShards*100 {
+		t.Fatalf("%d entries, expected %d", n, _addrCacheShards*100)
+	}
+	// the latest ones are there
+	for i := 9900; i < 10000; i++ {
+		if v, ok := c.get([]byte(strconv.Itoa(i))); !ok || string(v) != "addr"+strconv.Itoa(i) {
+			t.Fatalf("%d missing", i)
+		}
+	}
+
+	// entries read survive a flood of new ones
+	c = newAddrCache(_addrCacheShards*100, 0)
+	for i := 0; i < 1000; i++ {
+		c.set("hot"+strconv.Itoa(i), []byte("hot"))
+	}
+	for round := 0; round < 100; round++ {
+		for i := 0; i < 1000; i++ {
+			c.get([]byte("hot" + strconv.Itoa(i)))
+		}
+		for i := 0; i < 100; i++ {
+			c.set(strconv.Itoa(round*100+i), []byte("cold"))
+		}
+	}
+	hits := 0
+	for i := 0; i < 1000; i++ {
+		if _, ok := c.get([]byte("hot" + strconv.Itoa(i))); ok {
+			hits++
+		}
+	}
+	if hits < 900 {
+		t.Fatalf("%d of 1000 hot entries left", hits)
+	}
+}
+
+func TestAddrCacheTTL(t *testing.T) {
+	c := newAddrCache(1000, time.Millisecond*50)
+	c.set("a", []byte("1"))
+	if v, ok := c.get([]byte("a")); !ok || string(v) != "1" {
+		t.Fatal("entry missing")
+	}
+	time.Sleep(time.Millisecond * 60)
+	if _, ok := c.get([]byte("a")); ok {
+		t.Fatal("expired entry returned")
+	}
+	c.set("a", []byte("2"))
+	if v, ok := c.get([]byte("a")); !ok || string(v) != "2" {
+		t.Fatal("entry not replaced")
+	}
+	if c.len() != 1 {
+		t.Fatalf("%d entries", c.len())
+	}
+}
+
+func TestAddrCacheConcurrent(t *testing.T) {
+	c := newAddrCache(_addrCacheShards*10, time.Minute)
+	var wg sync.WaitGroup
+	for g := 0; g < 8; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			for i := 0; i < 5000; i++ {
+				k := strconv.Itoa((g*7919 + i) % 2000)
+				if v, ok := c.get([]byte(k)); ok && string(v) != k {
+					t.Errorf("%s cached as %s", k, v)
+					return
+				}
+				c.set(k, []byte(k))
+			}
+		}(g)
+	}
+	wg.Wait()
+}
+
+// the cipher texts of n backend addresses
+func benchmarkCipherAddrs(n int) [][]byte {
+	keys := make([][]byte, n)
+	for i := range keys {
+		keys[i] = []byte(strconv.Itoa(i) + "wfbLuT7xNtxm0aGTOVgo8A6F2u/ORO7E5pWqZ1G0R5w=")
+	}
+	return keys
+}
+
+func BenchmarkAddrCacheHitParallel(b *testing.B) {
+	c := newAddrCache(_MaxBackendAddrCacheCount, time.Hour)
+	keys := benchmarkCipherAddrs(10000)
+	for _, k := range keys {
+		c.set(string(k), _echoServerAddr)
+	}
+	b.ResetTimer()
+	var n uint32
+	b.RunParallel(func(pb *testing.PB) {
+		i := int(atomic.AddUint32(&n, 7919))
+		for pb.Next() {
+			c.get(keys[i%len(keys)])
+			i++
+		}
+	})
+}
+
+// every lookup misses and is followed by an insert, with the cache full, as
+// under a flood of unique tokens
+func BenchmarkAddrCacheMissParallel(b *testing.B) {
+	c := newAddrCache(100000, time.Hour)
+	for _, k := range benchmarkCipherAddrs(100000) {
+		c.set("warm"+string(k), _echoServerAddr)
+	}
+	b.ResetTimer()
+	var n uint32
+	b.RunParallel(func(pb *testing.PB) {
+		prefix := strconv.Itoa(int(atomic.AddUint32(&n, 1))) + "-"
+		for i := 0; pb.Next(); i++ {
+			k := []byte(prefix + strconv.Itoa(i))
+			if _, ok := c.get(k); !ok {
+				c.set(string(k), _echoServerAddr)
+			}
+		}
+	})
+}
+
+// the copy-on-write map the cache replaced, for comparison
+func BenchmarkCopyOnWriteMissParallel(b *testing.B) {
+	var mu sync.Mutex
+	var cache atomic.Value
+	m := make(map[string][]byte)
+	for _, k := range benchmarkCipherAddrs(100000) {
+		m["warm"+string(k)] = _echoServerAddr
+	}
+	cache.Store(m)
+	b.ResetTimer()
+	var n uint32
+	b.RunParallel(func(pb *testing.PB) {
+		prefix := strconv.Itoa(int(atomic.AddUint32(&n, 1))) + "-"
+		for i := 0; pb.Next(); i++ {
+			k := prefix + strconv.Itoa(i)
+			if _, ok := cache.Load().(map[string][]byte)[k]; ok {
+				continue
+			}
+			mu.Lock()
+			m1 := cache.Load().(map[string][]byte)
+			m2 := make(map[string][]byte, len(m1)+1)
+			for k, v := range m1 {
+				m2[k] = v
+			}
+			m2[k] = _echoServerAddr
+			cache.Store(m2)
+			mu.Unlock()
+		}
+	})
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"errors"
+	"expvar"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync/atomic"
+)
+
+var (
+	// path of the canary file, which sends a share of the connections of
+	// logical services to other targets
+	_CanaryConfig string
+
+	// canaryTable, replaced as a whole on reload
+	_canaries atomic.Value
+	// connections sent to the canary of every service
+	_canaryHits = new(expvar.Map).Init()
+)
+
+// canary sends percent of the connections to a service to target instead
+type canary struct {
+	Target  string  `json:"target"`
+	Percent float64 `json:"percent"`
+	// by the hash of the client IP rather than at random, so a player stays
+	// on the same side as long as the percentage does not shrink
+	ByClient bool `json:"by_client"`
+}
+
+// canaryTable maps services, as decrypted or rewritten, to their canaries
+type canaryTable map[string]canary
+
+func init() {
+	_canaries.Store(canaryTable{})
+	_metrics.Set("canary_hits", _canaryHits)
+	http.HandleFunc("/admin/canaries", serveAdminCanaries)
+}
+
+// canaryTarget returns the target a connection from client to service goes to
+func canaryTarget(service, client string) string {
+	c, ok := _canaries.Load().(canaryTable)[service]
+	if !ok {
+		return service
+	}
+	var n float64
+	if c.ByClient {
+		n = float64(hashString(service, "|", client)%10000) / 100
+	} else {
+		n = rand.Float64() * 100
+	}
+	if n >= c.Percent {
+		return service
+	}
+	_canaryHits.Add(service, 1)
+	return c.Target
+}
+
+// loadCanaryConfig reads a canary file and makes it the current one. Every
+// line holds a service, its canary target, the percentage of connections sent
+// there and optionally "ip" to split by client IP, e.g.
+//
+//	zone-3 zone-3-canary 10 ip
+//	consul://zone-4-gate consul://zone-4-gate-canary 5
+//
+// Empty lines and lines starting with # are skipped.
+func loadCanaryConfig(path string) error {
+	canaries := make(canaryTable)
+	err := readConfigLines(path, func(fields []string) error {
+		if len(fields) != 3 && !(len(fields) == 4 && fields[3] == "ip") {
+			return errors.New("expected a service, its canary, a percentage and optionally ip")
+		}
+		service, target := fields[0], fields[1]
+		if _, ok := canaries[service]; ok {
+			return fmt.Errorf("duplicated service %q", service)
+		}
+		percent, err := strconv.ParseFloat(strings.TrimSuffix(fields[2], "%"), 64)
+		if err != nil || percent < 0 || percent > 100 {
+			return fmt.Errorf("invalid percentage %q", fields[2])
+		}
+		if err := checkTarget(target, true); err != nil {
+			return err
+		}
+		canaries[service] = canary{target, percent, len(fields) == 4}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	_canaries.Store(canaries)
+	return nil
+}
+
+func serveAdminCanaries(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, _canaries.Load().(canaryTable))
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestCanaryTarget(t *testing.T) {
+	defer _canaries.Store(canaryTable{})
+
+	_canaries.Store(canaryTable{"svc": {Target: "canary", Percent: 50}})
+	hits := 0
+	for i := 0; i < 1000; i++ {
+		if canaryTarget("svc", "10.0.0.1") == "canary" {
+			hits++
+		}
+	}
+	if hits < 400 || hits > 600 {
+		t.Fatalf("%d of 1000 connections to the canary", hits)
+	}
+	if canaryTarget("other", "10.0.0.1") != "other" {
+		t.Fatal("service without canary rerouted")
+	}
+
+	// by client IP, the players on the canary stay there when it grows
+	_canaries.Store(canaryTable{"svc": {Target: "canary", Percent: 10, ByClient: true}})
+	var onCanary []string
+	for i := 0; i < 1000; i++ {
+		ip := "10.0." + strconv.Itoa(i/256) + "." + strconv.Itoa(i%256)
+		if canaryTarget("svc", ip) == "canary" {
+			if canaryTarget("svc", ip) != "canary" {
+				t.Fatalf("%s moved between connections", ip)
+			}
+			onCanary = append(onCanary, ip)
+		}
+	}
+	if len(onCanary) < 50 || len(onCanary) > 150 {
+		t.Fatalf("%d of 1000 clients on the canary", len(onCanary))
+	}
+	_canaries.Store(canaryTable{"svc": {Target: "canary", Percent: 20, ByClient: true}})
+	for _, ip := range onCanary {
+		if canaryTarget("svc", ip) != "canary" {
+			t.Fatalf("%s left the canary", ip)
+		}
+	}
+}
+
+func TestCanaryConfig(t *testing.T) {
+	_reloadEvery = time.Millisecond * 20
+	dir, err := ioutil.TempDir("", "frontd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		os.RemoveAll(dir)
+		_canaries.Store(canaryTable{})
+		_reloadEvery = time.Second * 5
+	}()
+
+	// all connections to a dead service go to the canary
+	service := "127.0.0.1:62869"
+	path := filepath.Join(dir, "canaries")
+	writeFileAtomic(t, path, service+" "+string(_echoServerAddr)+" 100% ip\n")
+	stop, err := loadAndWatch(path, loadCanaryConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stop()
+	b, err := encryptText([]byte(service), _secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := net.Dial("tcp", _defaultFrontdAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Write(append(b, '\n'))
+	testEchoRound(conn)
+	conn.Close()
+
+	writeFileAtomic(t, path, service+" "+string(_echoServerAddr)+" 0\n")
+	waitFor(t, "canaries not reloaded", func() bool { return canaryTarget(service, "") == service })
+	testProtocol(append(b, '\n'), []byte("4102"))
+
+	for _, content := range []string{
+		"svc canary",
+		"svc canary 101",
+		"svc canary 10 x",
+		"svc canary 10\nsvc canary 20",
+		"svc canary?lb=x 10",
+	} {
+		writeFileAtomic(t, path, content)
+		if err := loadCanaryConfig(path); err == nil {
+			t.Errorf("%q should not load", content)
+		}
+	}
+}
@@ -0,0 +1,208 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"expvar"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+)
+
+var (
+	// host:port of the Consul HTTP API, consul:// targets fail without it
+	_ConsulAddr  string
+	_ConsulToken string
+
+	// longest a blocking query waits for a change
+	_consulWait = time.Minute * 5
+	// a service no client asked for this long is no longer watched
+	_consulIdle     = time.Minute * 10
+	_consulRetryMax = time.Minute
+
+	_consul = &consulWatcher{services: make(map[string]*consulService)}
+)
+
+var (
+	errConsulDisabled = errors.New("consul address not configured")
+	errConsulTimeout  = errors.New("consul lookup timeout")
+)
+
+func init() {
+	_resolvers["consul"] = _consul.resolve
+	_metrics.Set("consul_services", expvar.Func(func() interface{} {
+		return _consul.instances()
+	}))
+}
+
+// consulService is the cached list of passing instances of a service
+type consulService struct {
+	name string
+	// closed once the first query is answered
+	ready    chan struct{}
+	addrs    []string
+	err      error
+	lastUsed time.Time
+}
+
+// consulWatcher keeps the instances of every service in use up to date with
+// blocking queries on the health API, so lookups are answered from memory
+type consulWatcher struct {
+	mu       sync.Mutex
+	services map[string]*consulService
+}
+
+// resolve returns the addresses of the passing instances of a service. The
+// first lookup of a service waits for Consul, as long as a backend dial.
+func (w *consulWatcher) resolve(name string) ([]string, error) {
+	if len(_ConsulAddr) == 0 {
+		return nil, errConsulDisabled
+	}
+
+	w.mu.Lock()
+	s, ok := w.services[name]
+	if !ok {
+		s = &consulService{name: name, ready: make(chan struct{}), lastUsed: time.Now()}
+		w.services[name] = s
+		go w.watch(s)
+	}
+	w.mu.Unlock()
+
+	timer := time.NewTimer(time.Second * time.Duration(_BackendDialTimeout))
+	defer timer.Stop()
+	select {
+	case <-s.ready:
+	case <-timer.C:
+		return nil, errConsulTimeout
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	s.lastUsed = time.Now()
+	return s.addrs, s.err
+}
+
+// watch follows the changes of a service until it is idle. The last known
+// instances are kept while Consul is unreachable.
+func (w *consulWatcher) watch(s *consulService) {
+	var index uint64
+	retry := time.Second
+	for first := true; ; first = false {
+		addrs, newIndex, err := queryConsulHealth(s.name, index)
+
+		w.mu.Lock()
+		if err == nil {
+			s.addrs, s.err = addrs, nil
+		} else if first {
+			s.err = err
+		}
+		idle := time.Since(s.lastUsed) > _consulIdle
+		if idle {
+			delete(w.services, s.name)
+		}
+		w.mu.Unlock()
+		if first {
+			close(s.ready)
+		}
+		if idle {
+			return
+		}
+
+		if err != nil {
+			countMetric("consul_errors")
+			log.Println("consul:", s.name, err)
+			time.Sleep(retry)
+			if retry *= 2; retry > _consulRetryMax {
+				retry = _consulRetryMax
+			}
+			continue
+		}
+		retry = time.Second
+		// the index may go backwards, e.g. when Consul is restored from a
+		// snapshot
+		if newIndex < index {
+			newIndex = 0
+		}
+		index = newIndex
+	}
+}
+
+// instances returns the number of passing instances of every service watched
+func (w *consulWatcher) instances() map[string]int {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	m := make(map[string]int, len(w.services))
+	for name, s := range w.services {
+		m[name] = len(s.addrs)
+	}
+	return m
+}
+
+// consulHealthEntry is the part of /v1/health/service used by frontd
+type consulHealthEntry struct {
+	Node struct {
+		Address string
+	}
+	Service struct {
+		Address string
+		Port    int
+	}
+}
+
+// queryConsulHealth returns the passing instances of a service. With a
+// non-zero index it blocks until they change or _consulWait is over.
+func queryConsulHealth(name string, index uint64) ([]string, uint64, error) {
+	q := url.Values{"passing": {"1"}}
+	if index > 0 {
+		q.Set("index", strconv.FormatUint(index, 10))
+		q.Set("wait", _consulWait.String())
+	}
+	u := url.URL{
+		Scheme:   "http",
+		Host:     _ConsulAddr,
+		Path:     "/v1/health/service/" + name,
+		RawQuery: q.Encode(),
+	}
+	req, err := http.NewRequest("GET", u.String(), nil)
+	if err != nil {
+		return nil, 0, err
+	}
+	if len(_ConsulToken) > 0 {
+		req.Header.Set("X-Consul-Token", _ConsulToken)
+	}
+
+	// Consul adds up to wait/16 of jitter
+	client := http.Client{Timeout: _consulWait + _consulWait/16 + time.Second*10}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, 0, fmt.Errorf("consul replied %s", resp.Status)
+	}
+
+	var entries []consulHealthEntry
+	if err := json.NewDecoder(resp.Body).Decode(&entries); err != nil {
+		return nil, 0, err
+	}
+	newIndex, err := strconv.ParseUint(resp.Header.Get("X-Consul-Index"), 10, 64)
+	if err != nil {
+		return nil, 0, fmt.Errorf("invalid consul index %q", resp.Header.Get("X-Consul-Index"))
+	}
+
+	addrs := make([]string, 0, len(entries))
+	for _, e := range entries {
+		host := e.Service.Address
+		if len(host) == 0 {
+			host = e.Node.Address
+		}
+		addrs = append(addrs, net.JoinHostPort(host, strconv.Itoa(e.Service.Port)))
+	}
+	return addrs, newIndex, nil
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeConsul serves /v1/health/service/<name> with blocking queries
+type fakeConsul struct {
+	mu       sync.Mutex
+	index    uint64
+	services map[string][]consulHealthEntry
+	changed  chan struct{}
+	queries  int
+}
+
+func newFakeConsul() (*fakeConsul, *httptest.Server) {
+	fc := &fakeConsul{index: 1, services: make(map[string][]consulHealthEntry), changed: make(chan struct{})}
+	return fc, httptest.NewServer(fc)
+}
+
+func (fc *fakeConsul) set(name string, addrs ...string) {
+	var entries []consulHealthEntry
+	for _, addr := range addrs {
+		var e consulHealthEntry
+		host, port, _ := net.SplitHostPort(addr)
+		e.Node.Address = host
+		e.Service.Port, _ = strconv.Atoi(port)
+		entries = append(entries, e)
+	}
+	fc.mu.Lock()
+	fc.services[name] = entries
+	fc.index++
+	close(fc.changed)
+	fc.changed = make(chan struct{})
+	fc.mu.Unlock()
+}
+
+func (fc *fakeConsul) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	if q.Get("passing") != "1" {
+		http.Error(w, "passing instances only", http.StatusBadRequest)
+		return
+	}
+	fc.mu.Lock()
+	fc.queries++
+	index, changed := fc.index, fc.changed
+	fc.mu.Unlock()
+
+	if q.Get("index") == strconv.FormatUint(index, 10) {
+		wait, _ := time.ParseDuration(q.Get("wait"))
+		select {
+		case <-changed:
+		case <-time.After(wait):
+		}
+	}
+
+	fc.mu.Lock()
+	defer fc.mu.Unlock()
+	w.Header().Set("X-Consul-Index", strconv.FormatUint(fc.index, 10))
+	entries := fc.services[strings.TrimPrefix(r.URL.Path, "/v1/health/service/")]
+	if entries == nil {
+		entries = []consulHealthEntry{}
+	}
+	json.NewEncoder(w).Encode(entries)
+}
+
+// useFakeConsul points frontd to a fake Consul, the returned function stops
+// the watchers and restores the settings
+func useFakeConsul() (*fakeConsul, func()) {
+	fc, s := newFakeConsul()
+	_ConsulAddr = strings.TrimPrefix(s.URL, "http://")
+	_consulWait = time.Second
+	return fc, func() {
+		_consulIdle = 0
+		s.Close()
+		for i := 0; i < 100 && len(_consul.instances()) > 0; i++ {
+			time.Sleep(time.Millisecond * 50)
+		}
+		_ConsulAddr, _consulWait, _consulIdle = "", time.Minute*5, time.Minute*10
+	}
+}
+
+func TestConsulResolve(t *testing.T) {
+	if _, err := _consul.resolve("game"); err != errConsulDisabled {
+		t.Fatalf("expected disabled consul, got %v", err)
+	}
+
+	fc, done := useFakeConsul()
+	defer done()
+	fc.set("game", "127.0.0.1:9000", "[::1]:9001")
+
+	addrs, err := _consul.resolve("game")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(addrs, []string{"127.0.0.1:9000", "[::1]:9001"}) {
+		t.Fatalf("unexpected instances %v", addrs)
+	}
+
+	// lookups are answered from the cache
+	for i := 0; i < 100; i++ {
+		_consul.resolve("game")
+	}
+	fc.mu.Lock()
+	queries := fc.queries
+	fc.mu.Unlock()
+	if queries > 2 {
+		t.Fatalf("%d queries to consul", queries)
+	}
+
+	// the watch picks up changes
+	fc.set("game", "127.0.0.1:9002")
+	for i := 0; ; i++ {
+		addrs, _ = _consul.resolve("game")
+		if reflect.DeepEqual(addrs, []string{"127.0.0.1:9002"}) {
+			break
+		}
+		if i > 100 {
+			t.Fatalf("change not watched: %v", addrs)
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+}
+
+func TestConsulTarget(t *testing.T) {
+	fc, done := useFakeConsul()
+	defer done()
+	fc.set("echo", "127.0.0.1:62868", string(_echoServerAddr))
+
+	b, err := encryptText([]byte("consul://echo"), _secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		conn, err := net.Dial("tcp", _defaultFrontdAddr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn.Write(append(b, '\n'))
+		testEchoRound(conn)
+		conn.Close()
+	}
+
+	// no passing instance
+	b, err = encryptText([]byte("consul://nothing"), _secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testProtocol(append(b, '\n'), []byte("4102"))
+}
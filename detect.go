@@ -0,0 +1,298 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+
+	"golang.org/x/net/http2"
+)
+
+// protocol a client connection speaks
+type protocol int
+
+const (
+	protoUnknown protocol = iota
+	protoBinary
+	protoTLS
+	protoHTTP2
+	protoHTTP
+	protoText
+)
+
+// protocols which a listening port can be dedicated to
+var _protocolByMode = map[string]protocol{
+	"binary": protoBinary,
+	"tls":    protoTLS,
+	"h2c":    protoHTTP2,
+	"http":   protoHTTP,
+	"text":   protoText,
+}
+
+// A protocolDetector looks at the first bytes of a connection. It returns
+// needMore if it can not tell yet whether they belong to its protocol.
+type protocolDetector struct {
+	proto  protocol
+	detect func(b []byte) (match, needMore bool)
+}
+
+// _protocolDetectors in order of precedence, a detector waiting for more
+// data holds back the ones after it. Connections matching none of them are
+// handled as the text protocol, which reports the error. A PROXY protocol
+// header is not detected, it is required where enabled.
+var _protocolDetectors = []protocolDetector{
+	{protoBinary, detectBinary},
+	{protoTLS, detectTLS},
+	{protoHTTP2, detectHTTP2},
+	{protoHTTP, detectHTTP},
+	{protoText, detectText},
+}
+
+// detectProtocol peeks at the connection until a detector matches, TLS is
+// only detected if tls is set. A detector still waiting when the buffer of
+// rdr is full is returned along with bufio.ErrBufferFull.
+func detectProtocol(rdr *bufio.Reader, tls bool) (protocol, error) {
+	for n := 1; ; n++ {
+		if rdr.Buffered() > n {
+			n = rdr.Buffered()
+		}
+		b, err := rdr.Peek(n)
+		if len(b) == 0 {
+			return protoUnknown, err
+		}
+		// no more data is coming
+		final := err != nil && err != bufio.ErrBufferFull
+
+		pending := false
+		for _, d := range _protocolDetectors {
+			if d.proto == protoTLS && !tls {
+				continue
+			}
+			match, needMore := d.detect(b)
+			if match {
+				return d.proto, nil
+			}
+			if needMore && !final {
+				if err == bufio.ErrBufferFull {
+					// the protocol of the detector unless the buffer grows
+					return d.proto, err
+				}
+				pending = true
+				break
+			}
+		}
+		if !pending {
+			return protoText, nil
+		}
+	}
+}
+
+// parseListenMode parses a "port=mode" entry of LISTEN_MODES
+func parseListenMode(s string) (int, protocol, error) {
+	kv := strings.SplitN(strings.TrimSpace(s), "=", 2)
+	if len(kv) != 2 {
+		return 0, protoUnknown, fmt.Errorf("invalid listen mode %q", s)
+	}
+	port, err := strconv.Atoi(kv[0])
+	if err != nil || port <= 0 || port > 65535 {
+		return 0, protoUnknown, fmt.Errorf("invalid listen mode port %q", s)
+	}
+	proto, ok := _protocolByMode[kv[1]]
+	if !ok {
+		return 0, protoUnknown, fmt.Errorf("unknown listen mode %q", s)
+	}
+	if proto == protoTLS && _TLSConfig == nil && len(_SNIDomain) == 0 {
+		return 0, protoUnknown, errors.New("tls listen mode requires TLS_CERT and TLS_KEY or SNI_DOMAIN")
+	}
+	return port, proto, nil
+}
+
+// matchPrefix tells how b compares to the start of a signature
+func matchPrefix(b []byte, sig string) (match, needMore bool) {
+	if len(b) < len(sig) {
+		return false, strings.HasPrefix(sig, string(b))
+	}
+	return strings.HasPrefix(string(b), sig), false
+}
+
+var (
+	_proxyV1Sig = "PROXY "
+	_proxyV2Sig = "\r\n\r\n\x00\r\nQUIT\n"
+)
+
+func detectBinary(b []byte) (match, needMore bool) {
+	return b[0] == 0x00, false
+}
+
+// detectTLS looks for a handshake record of TLS 1.x
+func detectTLS(b []byte) (match, needMore bool) {
+	return matchPrefix(b, "\x16\x03")
+}
+
+func detectHTTP2(b []byte) (match, needMore bool) {
+	return matchPrefix(b, http2.ClientPreface)
+}
+
+// detectHTTP matches an HTTP/1.x request line:
+// method SP request-target SP "HTTP/1." DIGIT CRLF
+func detectHTTP(b []byte) (match, needMore bool) {
+	i := 0
+	for i < len(b) && i < 24 && b[i] >= 'A' && b[i] <= 'Z' {
+		i++
+	}
+	if i == len(b) {
+		return false, true
+	}
+	if i == 0 || b[i] != ' ' {
+		return false, false
+	}
+	i++
+
+	start := i
+	for i < len(b) && b[i] > ' ' && b[i] < 0x7f {
+		i++
+	}
+	if i == len(b) {
+		return false, true
+	}
+	if i == start || b[i] != ' ' {
+		return false, false
+	}
+	i++
+
+	version := b[i:]
+	if len(version) > 8 {
+		version = version[:8]
+	}
+	if match, needMore = matchPrefix(version, "HTTP/1."); !match {
+		return false, needMore
+	}
+	if len(version) < 8 {
+		return false, true
+	}
+	if version[7] < '0' || version[7] > '9' {
+		return false, false
+	}
+
+	rest := b[i+8:]
+	if len(rest) == 0 || (rest[0] == '\r' && len(rest) == 1) {
+		return false, true
+	}
+	return rest[0] == '\n' || (rest[0] == '\r' && rest[1] == '\n'), false
+}
+
+// detectText matches a line of base64 text
+func detectText(b []byte) (match, needMore bool) {
+	for i, c := range b {
+		switch {
+		case c >= 'A' && c <= 'Z', c >= 'a' && c <= 'z', c >= '0' && c <= '9',
+			c == '+', c == '/', c == '-', c == '_', c == '=':
+		case c == '\n':
+			return i > 0, false
+		case c == '\r':
+			if i == len(b)-1 {
+				return false, true
+			}
+			return i > 0 && b[i+1] == '\n', false
+		default:
+			return false, false
+		}
+	}
+	return false, true
+}
+
+// proxyConn reports the client address from the PROXY protocol header
+type proxyConn struct {
+	net.Conn
+	remoteAddr net.Addr
+}
+
+func (c *proxyConn) RemoteAddr() net.Addr {
+	return c.remoteAddr
+}
+
+// handleProxyHdr reads the PROXY protocol v1 or v2 header a connection has to
+// start with, see
+// http://www.haproxy.org/download/1.8/doc/proxy-protocol.txt
+func handleProxyHdr(rdr *bufio.Reader, c net.Conn) (net.Conn, error) {
+	b, err := rdr.Peek(len(_proxyV2Sig))
+	if err == nil && string(b) == _proxyV2Sig {
+		return handleProxyV2Hdr(rdr, c)
+	}
+
+	b, err = rdr.Peek(len(_proxyV1Sig))
+	if err != nil || string(b) != _proxyV1Sig {
+		return c, errors.New("proxy protocol header missing")
+	}
+
+	// v1 header is a single line of at most 107 bytes
+	var line []byte
+	for len(line) < 107 {
+		b, err := rdr.ReadByte()
+		if err != nil {
+			return c, err
+		}
+		line = append(line, b)
+		if b == '\n' {
+			break
+		}
+	}
+	if !bytes.HasSuffix(line, []byte("\r\n")) {
+		return c, errors.New("proxy protocol header too long")
+	}
+
+	fields := strings.Fields(string(line))
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return c, nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return c, fmt.Errorf("invalid proxy protocol header %q", line)
+	}
+	ip := net.ParseIP(fields[2])
+	port, err := strconv.Atoi(fields[4])
+	if ip == nil || err != nil {
+		return c, fmt.Errorf("invalid proxy protocol header %q", line)
+	}
+	return &proxyConn{c, &net.TCPAddr{IP: ip, Port: port}}, nil
+}
+
+func handleProxyV2Hdr(rdr *bufio.Reader, c net.Conn) (net.Conn, error) {
+	hdr := make([]byte, 16)
+	if _, err := io.ReadFull(rdr, hdr); err != nil {
+		return c, err
+	}
+	if hdr[12]>>4 != 2 {
+		return c, errors.New("unsupported proxy protocol version")
+	}
+	addrs := make([]byte, binary.BigEndian.Uint16(hdr[14:]))
+	if _, err := io.ReadFull(rdr, addrs); err != nil {
+		return c, err
+	}
+
+	// LOCAL command, the connection is from the proxy itself
+	if hdr[12]&0x0f == 0 {
+		return c, nil
+	}
+
+	switch hdr[13] {
+	case 0x11: // TCP over IPv4
+		if len(addrs) < 12 {
+			return c, errors.New("short proxy protocol address")
+		}
+		ip := net.IP(append([]byte{}, addrs[:4]...))
+		return &proxyConn{c, &net.TCPAddr{IP: ip, Port: int(binary.BigEndian.Uint16(addrs[8:]))}}, nil
+	case 0x21: // TCP over IPv6
+		if len(addrs) < 36 {
+			return c, errors.New("short proxy protocol address")
+		}
+		ip := net.IP(append([]byte{}, addrs[:16]...))
+		return &proxyConn{c, &net.TCPAddr{IP: ip, Port: int(binary.BigEndian.Uint16(addrs[32:]))}}, nil
+	}
+	return c, nil
+}
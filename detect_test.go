@@ -0,0 +1,192 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// startListener serves l on a port of its own, the tests needing other
+// settings than the shared frontd do not change those under its feet
+func startListener(t testing.TB, l *listener) (addr string, stop func()) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go l.serve(ln)
+	return ln.Addr().String(), func() { ln.Close() }
+}
+
+// dialListener connects to a listener of startListener
+func dialListener(t testing.TB, addr string) net.Conn {
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.SetDeadline(time.Now().Add(time.Second * 5))
+	return conn
+}
+
+func TestDetectProtocol(t *testing.T) {
+	for _, c := range []struct {
+		in    string
+		proto protocol
+	}{
+		{"\x00\x20Salted__", protoBinary},
+		{"U2FsdGVkX19KIJ9OQJKT/yHGMrS+5SsBAAjetomptQ0=\n", protoText},
+		{"U2FsdGVkX19KIJ9OQJKT/yHGMrS+5SsBAAjetomptQ0=\r\n", protoText},
+		// a ciphertext is free to contain "HTTP"
+		{"U2FsdGVkX19HTTPOQJKT/yHGMrS+5SsBAAjetomptQ0=\n", protoText},
+		{"GET / HTTP/1.1\r\nHost: a\r\n\r\n", protoHTTP},
+		{"OPTIONS * HTTP/1.0\n", protoHTTP},
+		{"GET /a b HTTP/1.1\r\n", protoText},
+		{"GET / HTTP/2.0\r\n", protoText},
+		{"PRI * HTTP/2.0\r\n\r\nSM\r\n\r\n", protoHTTP2},
+		// only read where required
+		{"PROXY TCP4 1.2.3.4 5.6.7.8 1 2\r\n", protoText},
+		// TLS is not configured
+		{"\x16\x03\x01\x02\x00\x01", protoText},
+		{"garbage\x01\n", protoText},
+	} {
+		proto, err := detectProtocol(bufio.NewReader(strings.NewReader(c.in)), false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if proto != c.proto {
+			t.Errorf("%q detected as %d, expected %d", c.in, proto, c.proto)
+		}
+	}
+
+	hello := "\x16\x03\x01\x02\x00\x01"
+	if proto, _ := detectProtocol(bufio.NewReader(strings.NewReader(hello)), true); proto != protoTLS {
+		t.Errorf("TLS detected as %d", proto)
+	}
+	if proto, _ := detectProtocol(bufio.NewReader(strings.NewReader(hello)), false); proto == protoTLS {
+		t.Error("TLS detected without TLS served")
+	}
+}
+
+// TestDetectProtocolShortLine makes sure a short line does not wait for more
+// data to rule out the other protocols
+func TestDetectProtocolShortLine(t *testing.T) {
+	testProtocol([]byte("PRI\n"), []byte("4106"))
+	testProtocol([]byte("GET\n"), []byte("4106"))
+}
+
+func TestProxyProtocol(t *testing.T) {
+	addr, stop := startListener(t, &listener{proxyProtocol: true})
+	defer stop()
+
+	a, cipherA := newTestBackend("A")
+	defer a.Close()
+
+	v2 := []byte("\r\n\r\n\x00\r\nQUIT\n\x21\x11\x00\x0c")
+	v2 = append(v2, 5, 6, 7, 8, 9, 9, 9, 9, 0x04, 0x57, 0x00, 0x50)
+
+	for preamble, expected := range map[string]string{
+		"PROXY TCP4 1.2.3.4 9.9.9.9 1111 80\r\n":         "A|1.2.3.4|",
+		"PROXY TCP6 2001:db8::1 2001:db8::2 1111 80\r\n": "A|[2001:db8::1]|",
+		"PROXY UNKNOWN\r\n":                              "A|127.0.0.1|",
+		string(v2):                                       "A|5.6.7.8|",
+	} {
+		conn, err := net.Dial("tcp", addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn.SetDeadline(time.Now().Add(time.Second * 5))
+		fmt.Fprintf(conn, "%sGET / HTTP/1.1\r\nHost: a\r\nX-Cipher-Origin: %s\r\nConnection: close\r\n\r\n", preamble, cipherA)
+		b, err := ioutil.ReadAll(conn)
+		conn.Close()
+		if !bytes.HasSuffix(b, []byte(expected)) {
+			t.Errorf("%q: expected %q, got %q (%v)", preamble, expected, b, err)
+		}
+	}
+}
+
+func TestProxyProtocolRequired(t *testing.T) {
+	trusted, err := parseCIDRs("127.0.0.0/8, ::1")
+	if err != nil || len(trusted) != 2 || !trusted[1].Contains(net.ParseIP("::1")) {
+		t.Fatalf("unexpected %v %v", trusted, err)
+	}
+	for _, s := range []string{"127.0.0.1/33", "localhost"} {
+		if _, err := parseCIDRs(s); err == nil {
+			t.Errorf("%q should not parse", s)
+		}
+	}
+
+	addr, stop := startListener(t, &listener{proxyProtocol: true, proxyTrusted: trusted})
+	defer stop()
+	b, err := encryptText(_echoServerAddr, _secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for preamble, expected := range map[string]string{
+		// straight from a client
+		"":                           "4103",
+		"PROXY TCP4 1.2.3.4 9.9.9.9": "4103",
+	} {
+		conn, err := net.Dial("tcp", addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn.SetDeadline(time.Now().Add(time.Second * 5))
+		fmt.Fprintf(conn, "%s%s\n", preamble, b)
+		got, _ := ioutil.ReadAll(conn)
+		conn.Close()
+		if string(got) != expected {
+			t.Errorf("%q: expected %q, got %q", preamble, expected, got)
+		}
+	}
+
+	// a client may not pose as a proxy
+	untrusted := metricValue("proxy_untrusted")
+	_, n, _ := net.ParseCIDR("10.0.0.0/8")
+	addr, stop = startListener(t, &listener{proxyProtocol: true, proxyTrusted: []*net.IPNet{n}})
+	defer stop()
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(time.Second * 5))
+	fmt.Fprintf(conn, "PROXY TCP4 1.2.3.4 9.9.9.9 1111 80\r\n%s\n", b)
+	if got, _ := ioutil.ReadAll(conn); string(got) != "4100" {
+		t.Fatalf("expected 4100, got %q", got)
+	}
+	if metricValue("proxy_untrusted") != untrusted+1 {
+		t.Fatal("untrusted proxy not counted")
+	}
+}
+
+func TestListenMode(t *testing.T) {
+	for _, s := range []string{"4044", "x=http", "4044=ftp", "70000=http", "4044=tls"} {
+		if _, _, err := parseListenMode(s); err == nil {
+			t.Errorf("%q should not parse", s)
+		}
+	}
+	port, proto, err := parseListenMode(" 4044=binary")
+	if err != nil || port != 4044 || proto != protoBinary {
+		t.Errorf("unexpected %d %d %v", port, proto, err)
+	}
+
+	// a port dedicated to the text protocol does not look for HTTP
+	addr, stop := startListener(t, &listener{proto: protoText})
+	defer stop()
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(time.Second * 5))
+	fmt.Fprintf(conn, "GET / HTTP/1.1\r\n\r\n")
+	b, _ := ioutil.ReadAll(conn)
+	if string(b) != "4106" {
+		t.Fatalf("expected 4106, got %q", b)
+	}
+}
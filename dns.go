@@ -0,0 +1,403 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+var (
+	// host:port of the DNS server, the first nameserver of /etc/resolv.conf
+	// by default
+	_DNSServer string
+	// how long an expired answer is still used while it is being refreshed
+	_DNSStale = time.Minute * 5
+
+	_dnsTimeout     = time.Second * 2
+	_dnsNegativeTTL = time.Second * 5
+	_dnsMinTTL      = time.Second
+	// the system resolver tells no TTL
+	_dnsSystemTTL = time.Second * 30
+
+	_dns = &dnsCache{m: make(map[string]*dnsEntry)}
+)
+
+var errNoAnswer = errors.New("no dns answer")
+
+func init() {
+	_resolvers["srv"] = resolveSRV
+}
+
+// dnsAnswer holds the records of one question, or why there are none
+type dnsAnswer struct {
+	ips  []net.IP
+	srvs []net.SRV
+	err  error
+}
+
+type dnsEntry struct {
+	ans     dnsAnswer
+	expires time.Time
+	// closed when the query in flight is answered
+	pending chan struct{}
+}
+
+// dnsCache keeps answers for their TTL. Expired ones are used for another
+// _DNSStale while they are refreshed in the background, so clients never
+// wait for DNS once a name is known.
+type dnsCache struct {
+	mu sync.Mutex
+	m  map[string]*dnsEntry
+}
+
+// lookup returns the cached answer for key, asking query when there is none
+func (c *dnsCache) lookup(key string, query func() (dnsAnswer, time.Duration)) dnsAnswer {
+	now := time.Now()
+
+	c.mu.Lock()
+	e, ok := c.m[key]
+	if !ok {
+		e = &dnsEntry{}
+		c.m[key] = e
+	}
+	if ok && now.Before(e.expires) {
+		ans := e.ans
+		c.mu.Unlock()
+		return ans
+	}
+	stale := ok && e.ans.err == nil && now.Before(e.expires.Add(_DNSStale))
+	if e.pending == nil {
+		e.pending = make(chan struct{})
+		go c.refresh(e, query)
+	}
+	if stale {
+		ans := e.ans
+		c.mu.Unlock()
+		countMetric("dns_stale")
+		return ans
+	}
+	pending := e.pending
+	c.mu.Unlock()
+
+	<-pending
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return e.ans
+}
+
+func (c *dnsCache) refresh(e *dnsEntry, query func() (dnsAnswer, time.Duration)) {
+	ans, ttl := query()
+	now := time.Now()
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	switch {
+	case ans.err == nil:
+		e.ans, e.expires = ans, now.Add(ttl)
+	case e.ans.err == nil && now.Before(e.expires.Add(_DNSStale)):
+		// keep using the stale answer, the next lookup tries again
+		countMetric("dns_errors")
+	default:
+		countMetric("dns_errors")
+		e.ans, e.expires = ans, now.Add(_dnsNegativeTTL)
+	}
+	close(e.pending)
+	e.pending = nil
+}
+
+// lookupDNS asks the DNS server through the cache
+func lookupDNS(qtype dnsmessage.Type, name string) dnsAnswer {
+	return _dns.lookup(qtype.String()+" "+name, func() (dnsAnswer, time.Duration) {
+		return queryDNS(qtype, name)
+	})
+}
+
+// lookupHost returns the IPv4 and IPv6 addresses of a host. Unless
+// DNS_SERVER is set they come from the system resolver, which knows
+// /etc/hosts and the search domains of /etc/resolv.conf. Names the DNS
+// server does not know go to the system resolver as well.
+func lookupHost(host string) ([]net.IP, error) {
+	if len(_DNSServer) > 0 {
+		if ips, err := lookupHostDNS(host); err == nil {
+			return ips, nil
+		}
+	}
+	ans := _dns.lookup("host "+host, func() (dnsAnswer, time.Duration) {
+		return querySystem(host)
+	})
+	return ans.ips, ans.err
+}
+
+func lookupHostDNS(host string) ([]net.IP, error) {
+	a := lookupDNS(dnsmessage.TypeA, host)
+	aaaa := lookupDNS(dnsmessage.TypeAAAA, host)
+	ips := append(append([]net.IP(nil), a.ips...), aaaa.ips...)
+	if len(ips) == 0 {
+		if a.err != nil {
+			return nil, a.err
+		}
+		if aaaa.err != nil {
+			return nil, aaaa.err
+		}
+		return nil, errNoAnswer
+	}
+	return ips, nil
+}
+
+// querySystem asks the system resolver for the addresses of a host
+func querySystem(host string) (dnsAnswer, time.Duration) {
+	ctx, cancel := context.WithTimeout(context.Background(), _dnsTimeout)
+	defer cancel()
+	addrs, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return dnsAnswer{err: err}, 0
+	}
+	var ans dnsAnswer
+	for _, addr := range addrs {
+		ans.ips = append(ans.ips, addr.IP)
+	}
+	return ans, _dnsSystemTTL
+}
+
+// isHostName reports whether addr is a host:port to be resolved
+func isHostName(addr string) bool {
+	host, _, err := net.SplitHostPort(addr)
+	return err == nil && net.ParseIP(host) == nil
+}
+
+// expandHosts replaces the host names in addrs by their addresses
+func expandHosts(addrs []string) ([]string, error) {
+	var expanded []string
+	var lastErr error
+	for _, addr := range addrs {
+		if !isHostName(addr) {
+			expanded = append(expanded, addr)
+			continue
+		}
+		host, port, _ := net.SplitHostPort(addr)
+		ips, err := lookupHost(host)
+		if err != nil {
+			lastErr = fmt.Errorf("lookup %s: %v", host, err)
+			continue
+		}
+		for _, ip := range ips {
+			expanded = append(expanded, net.JoinHostPort(ip.String(), port))
+		}
+	}
+	if len(expanded) == 0 && lastErr != nil {
+		return nil, lastErr
+	}
+	return expanded, nil
+}
+
+// resolveSRV returns the addresses of a SRV name, ordered by priority and
+// then randomly by weight
+func resolveSRV(name string) ([]string, error) {
+	ans := lookupDNS(dnsmessage.TypeSRV, name)
+	if ans.err != nil {
+		return nil, ans.err
+	}
+	var addrs []string
+	for _, srv := range orderSRV(ans.srvs) {
+		addrs = append(addrs, net.JoinHostPort(strings.TrimSuffix(srv.Target, "."), strconv.Itoa(int(srv.Port))))
+	}
+	return expandHosts(addrs)
+}
+
+// orderSRV sorts by priority, records of the same priority are shuffled by
+// weight as described in RFC 2782
+func orderSRV(srvs []net.SRV) []net.SRV {
+	srvs = append([]net.SRV(nil), srvs...)
+	sort.SliceStable(srvs, func(i, j int) bool { return srvs[i].Priority < srvs[j].Priority })
+
+	for i := 0; i < len(srvs); {
+		j := i + 1
+		for j < len(srvs) && srvs[j].Priority == srvs[i].Priority {
+			j++
+		}
+		group := srvs[i:j]
+		for len(group) > 1 {
+			sum := 0
+			for _, srv := range group {
+				sum += int(srv.Weight)
+			}
+			// records of weight 0 are only picked when the others are gone
+			k := 0
+			if sum > 0 {
+				n := rand.Intn(sum)
+				for n >= int(group[k].Weight) {
+					n -= int(group[k].Weight)
+					k++
+				}
+			}
+			group[0], group[k] = group[k], group[0]
+			group = group[1:]
+		}
+		i = j
+	}
+	return srvs
+}
+
+// dnsServer returns _DNSServer or the first nameserver of /etc/resolv.conf
+func dnsServer() string {
+	if len(_DNSServer) > 0 {
+		return _DNSServer
+	}
+	f, err := os.Open("/etc/resolv.conf")
+	if err == nil {
+		defer f.Close()
+		s := bufio.NewScanner(f)
+		for s.Scan() {
+			fields := strings.Fields(s.Text())
+			if len(fields) > 1 && fields[0] == "nameserver" {
+				return net.JoinHostPort(fields[1], "53")
+			}
+		}
+	}
+	return "127.0.0.1:53"
+}
+
+// queryDNS asks the DNS server one question over UDP, or over TCP when the
+// answer is truncated. It returns the answer and its TTL.
+func queryDNS(qtype dnsmessage.Type, name string) (dnsAnswer, time.Duration) {
+	if !strings.HasSuffix(name, ".") {
+		name += "."
+	}
+	qname, err := dnsmessage.NewName(name)
+	if err != nil {
+		return dnsAnswer{err: err}, 0
+	}
+	id := uint16(rand.Uint32())
+	b := dnsmessage.NewBuilder(nil, dnsmessage.Header{ID: id, RecursionDesired: true})
+	b.EnableCompression()
+	b.StartQuestions()
+	b.Question(dnsmessage.Question{Name: qname, Type: qtype, Class: dnsmessage.ClassINET})
+	query, err := b.Finish()
+	if err != nil {
+		return dnsAnswer{err: err}, 0
+	}
+
+	resp, err := exchangeDNS("udp", query)
+	if err == nil && len(resp) > 2 && resp[2]&0x02 != 0 {
+		// truncated
+		resp, err = exchangeDNS("tcp", query)
+	}
+	if err != nil {
+		return dnsAnswer{err: err}, 0
+	}
+	return parseDNSAnswer(resp, id, qtype)
+}
+
+func exchangeDNS(network string, query []byte) ([]byte, error) {
+	conn, err := net.DialTimeout(network, dnsServer(), _dnsTimeout)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(_dnsTimeout))
+
+	if network == "udp" {
+		if _, err := conn.Write(query); err != nil {
+			return nil, err
+		}
+		buf := make([]byte, 4096)
+		n, err := conn.Read(buf)
+		return buf[:n], err
+	}
+
+	msg := make([]byte, 2+len(query))
+	binary.BigEndian.PutUint16(msg, uint16(len(query)))
+	copy(msg[2:], query)
+	if _, err := conn.Write(msg); err != nil {
+		return nil, err
+	}
+	var l [2]byte
+	if _, err := io.ReadFull(conn, l[:]); err != nil {
+		return nil, err
+	}
+	buf := make([]byte, binary.BigEndian.Uint16(l[:]))
+	_, err = io.ReadFull(conn, buf)
+	return buf, err
+}
+
+func parseDNSAnswer(resp []byte, id uint16, qtype dnsmessage.Type) (dnsAnswer, time.Duration) {
+	var p dnsmessage.Parser
+	h, err := p.Start(resp)
+	if err != nil {
+		return dnsAnswer{err: err}, 0
+	}
+	if h.ID != id {
+		return dnsAnswer{err: errors.New("dns id mismatch")}, 0
+	}
+	if h.RCode != dnsmessage.RCodeSuccess {
+		return dnsAnswer{err: fmt.Errorf("dns %s", h.RCode)}, 0
+	}
+	if err := p.SkipAllQuestions(); err != nil {
+		return dnsAnswer{err: err}, 0
+	}
+
+	var ans dnsAnswer
+	ttl := uint32(0)
+	for {
+		rh, err := p.AnswerHeader()
+		if err == dnsmessage.ErrSectionDone {
+			break
+		}
+		if err != nil {
+			return dnsAnswer{err: err}, 0
+		}
+		if rh.Type != qtype {
+			// e.g. CNAME
+			p.SkipAnswer()
+			continue
+		}
+		if ttl == 0 || rh.TTL < ttl {
+			ttl = rh.TTL
+		}
+		switch qtype {
+		case dnsmessage.TypeA:
+			r, err := p.AResource()
+			if err != nil {
+				return dnsAnswer{err: err}, 0
+			}
+			ans.ips = append(ans.ips, net.IP(r.A[:]))
+		case dnsmessage.TypeAAAA:
+			r, err := p.AAAAResource()
+			if err != nil {
+				return dnsAnswer{err: err}, 0
+			}
+			ans.ips = append(ans.ips, net.IP(r.AAAA[:]))
+		case dnsmessage.TypeSRV:
+			r, err := p.SRVResource()
+			if err != nil {
+				return dnsAnswer{err: err}, 0
+			}
+			ans.srvs = append(ans.srvs, net.SRV{Target: r.Target.String(), Port: r.Port, Priority: r.Priority, Weight: r.Weight})
+		default:
+			p.SkipAnswer()
+		}
+	}
+
+	if len(ans.ips) == 0 && len(ans.srvs) == 0 {
+		// no records of the type, e.g. no AAAA for an IPv4 only host
+		return dnsAnswer{}, _dnsNegativeTTL
+	}
+	d := time.Second * time.Duration(ttl)
+	if d < _dnsMinTTL {
+		d = _dnsMinTTL
+	}
+	return ans, d
+}
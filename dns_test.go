@@ -0,0 +1,221 @@
+package main
+
+import (
+	"net"
+	"reflect"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// dnsStub answers A and SRV questions from its records over UDP
+type dnsStub struct {
+	conn net.PacketConn
+
+	mu      sync.Mutex
+	hosts   map[string]net.IP
+	srvs    map[string][]net.SRV
+	ttl     uint32
+	queries int
+}
+
+func newDNSStub() *dnsStub {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		panic(err)
+	}
+	s := &dnsStub{conn: conn, hosts: make(map[string]net.IP), srvs: make(map[string][]net.SRV), ttl: 60}
+	go s.serve()
+	return s
+}
+
+func (s *dnsStub) serve() {
+	buf := make([]byte, 512)
+	for {
+		n, addr, err := s.conn.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		var p dnsmessage.Parser
+		h, err := p.Start(buf[:n])
+		if err != nil {
+			continue
+		}
+		q, err := p.Question()
+		if err != nil {
+			continue
+		}
+
+		s.mu.Lock()
+		s.queries++
+		rh := dnsmessage.ResourceHeader{Name: q.Name, Class: dnsmessage.ClassINET, TTL: s.ttl}
+		b := dnsmessage.NewBuilder(nil, dnsmessage.Header{ID: h.ID, Response: true})
+		b.StartQuestions()
+		b.Question(q)
+		b.StartAnswers()
+		switch q.Type {
+		case dnsmessage.TypeA:
+			if ip, ok := s.hosts[q.Name.String()]; ok {
+				var a dnsmessage.AResource
+				copy(a.A[:], ip.To4())
+				b.AResource(rh, a)
+			}
+		case dnsmessage.TypeSRV:
+			for _, srv := range s.srvs[q.Name.String()] {
+				b.SRVResource(rh, dnsmessage.SRVResource{
+					Priority: srv.Priority,
+					Weight:   srv.Weight,
+					Port:     srv.Port,
+					Target:   dnsmessage.MustNewName(srv.Target),
+				})
+			}
+		}
+		s.mu.Unlock()
+		resp, _ := b.Finish()
+		s.conn.WriteTo(resp, addr)
+	}
+}
+
+func (s *dnsStub) setHost(name string, ip string) {
+	s.mu.Lock()
+	s.hosts[name] = net.ParseIP(ip)
+	s.mu.Unlock()
+}
+
+// useDNSStub points frontd to a DNS stub with an empty cache
+func useDNSStub() (*dnsStub, func()) {
+	s := newDNSStub()
+	_DNSServer = s.conn.LocalAddr().String()
+	_dns = &dnsCache{m: make(map[string]*dnsEntry)}
+	return s, func() {
+		s.conn.Close()
+		_DNSServer = ""
+	}
+}
+
+func TestDNSCache(t *testing.T) {
+	stub, done := useDNSStub()
+	defer done()
+	stub.ttl = 1
+	stub.setHost("game.test.", "127.0.0.1")
+
+	for i := 0; i < 10; i++ {
+		ips, err := lookupHost("game.test")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(ips) != 1 || !ips[0].Equal(net.ParseIP("127.0.0.1")) {
+			t.Fatalf("unexpected addresses %v", ips)
+		}
+	}
+	stub.mu.Lock()
+	queries := stub.queries
+	stub.mu.Unlock()
+	if queries != 2 {
+		t.Fatalf("%d queries, expected A and AAAA once", queries)
+	}
+
+	// expired answers are used while being refreshed
+	stub.setHost("game.test.", "127.0.0.2")
+	time.Sleep(time.Millisecond * 1100)
+	ips, _ := lookupHost("game.test")
+	if !ips[0].Equal(net.ParseIP("127.0.0.1")) {
+		t.Fatalf("stale answer not used: %v", ips)
+	}
+	for i := 0; ; i++ {
+		ips, _ = lookupHost("game.test")
+		if ips[0].Equal(net.ParseIP("127.0.0.2")) {
+			break
+		}
+		if i > 100 {
+			t.Fatal("answer not refreshed")
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+
+	if _, err := lookupHost("nothing.test"); err == nil {
+		t.Fatal("unknown host resolved")
+	}
+}
+
+func TestDNSSystemHosts(t *testing.T) {
+	isLoopback := func(ips []net.IP) bool {
+		for _, ip := range ips {
+			if !ip.IsLoopback() {
+				return false
+			}
+		}
+		return len(ips) > 0
+	}
+
+	_dns = &dnsCache{m: make(map[string]*dnsEntry)}
+	if ips, err := lookupHost("localhost"); err != nil || !isLoopback(ips) {
+		t.Fatalf("localhost not resolved from /etc/hosts: %v %v", ips, err)
+	}
+
+	// names the DNS server does not know
+	_, done := useDNSStub()
+	defer done()
+	if ips, err := lookupHost("localhost"); err != nil || !isLoopback(ips) {
+		t.Fatalf("localhost not resolved with DNS_SERVER: %v %v", ips, err)
+	}
+}
+
+func TestOrderSRV(t *testing.T) {
+	srvs := []net.SRV{
+		{Target: "c", Priority: 20, Weight: 1},
+		{Target: "a", Priority: 10, Weight: 0},
+		{Target: "b", Priority: 10, Weight: 3},
+	}
+	first := make(map[string]int)
+	for i := 0; i < 100; i++ {
+		ordered := orderSRV(srvs)
+		if ordered[2].Target != "c" {
+			t.Fatalf("priority not respected: %v", ordered)
+		}
+		first[ordered[0].Target]++
+	}
+	if first["b"] != 100 {
+		t.Fatalf("weight 0 picked before weight 3: %v", first)
+	}
+}
+
+func TestSRVTarget(t *testing.T) {
+	stub, done := useDNSStub()
+	defer done()
+	stub.setHost("echo.test.", "127.0.0.1")
+	_, port, _ := net.SplitHostPort(string(_echoServerAddr))
+	echoPort, _ := strconv.Atoi(port)
+	stub.mu.Lock()
+	stub.srvs["_echo._tcp.test."] = []net.SRV{
+		// nothing listens on the preferred one
+		{Target: "echo.test.", Port: 62868, Priority: 1},
+		{Target: "echo.test.", Port: uint16(echoPort), Priority: 2},
+	}
+	stub.mu.Unlock()
+
+	addrs, err := resolveSRV("_echo._tcp.test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(addrs, []string{"127.0.0.1:62868", string(_echoServerAddr)}) {
+		t.Fatalf("unexpected addresses %v", addrs)
+	}
+
+	for _, target := range []string{"srv://_echo._tcp.test", "echo.test:" + port} {
+		b, err := encryptText([]byte(target), _secret)
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn, err := net.Dial("tcp", _defaultFrontdAddr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn.Write(append(b, '\n'))
+		testEchoRound(conn)
+		conn.Close()
+	}
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"crypto/sha256"
+	"errors"
+	"expvar"
+	"log"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+var errBadToken = errors.New("cipher address failed to decrypt recently")
+
+var (
+	// cipher addresses which failed to decrypt are remembered for
+	// _BadTokenTTL, so a replayed one costs no AES
+	_BadTokenCacheSize = 65536
+	_BadTokenTTL       = time.Minute * 10
+	_badTokens         = newAddrCache(_BadTokenCacheSize, _BadTokenTTL)
+
+	// concurrent decryptions, configured like the other admission gates
+	_decryptGate = newAdmissionGate("decrypt")
+
+	// decrypt failures of a client IP within _BanWindow which get it banned
+	// for _BanDuration, 0 disables bans
+	_BanFailures int
+	_BanWindow   = time.Minute
+	_BanDuration = time.Minute * 10
+
+	// bans of the listening ports, set up from the above by main
+	_bans = newBanTable(0, _BanWindow, _BanDuration)
+)
+
+func init() {
+	_metrics.Set("bans_active", expvar.Func(func() interface{} {
+		return len(_bans.list(time.Now()))
+	}))
+	http.HandleFunc("/admin/bans", serveAdminBans)
+}
+
+// badTokenKey is the key of a cipher address in _badTokens. Its hash keeps
+// the memory of the cache bounded however long garbage tokens are.
+func badTokenKey(cipherAddr []byte) []byte {
+	sum := sha256.Sum256(cipherAddr)
+	return sum[:]
+}
+
+// decryptFailed records that a cipher address of client was refused, and
+// returns the error code to answer with
+func (t *banTable) decryptFailed(client string, err error) []byte {
+	switch err {
+	case errServerBusy:
+		return []byte("4111")
+	case errReplayed:
+		return []byte("4113")
+	case errRevoked:
+		return []byte("4114")
+	}
+	countMetric("decrypt_failures")
+	t.fail(client, time.Now())
+	return []byte("4106")
+}
+
+// isBanned reports whether client is banned, and counts its rejection
+func (t *banTable) isBanned(client string) bool {
+	if !t.enabled() || !t.banned(client, time.Now()) {
+		return false
+	}
+	countMetric("ban_rejected")
+	return true
+}
+
+// banState counts the decrypt failures of a client IP in the current window
+type banState struct {
+	failures int
+	since    time.Time
+	until    time.Time
+}
+
+// banTable bans client IPs sending too many cipher addresses which fail to
+// decrypt, as fail2ban does. A nil one bans nobody.
+type banTable struct {
+	// decrypt failures within window which get a client IP banned for
+	// duration, 0 disables bans
+	failures int
+	window   time.Duration
+	duration time.Duration
+
+	mu sync.Mutex
+	m  map[string]*banState
+}
+
+func newBanTable(failures int, window, duration time.Duration) *banTable {
+	return &banTable{failures: failures, window: window, duration: duration, m: make(map[string]*banState)}
+}
+
+func (t *banTable) enabled() bool {
+	return t != nil && t.failures > 0
+}
+
+func (t *banTable) fail(client string, now time.Time) {
+	if !t.enabled() {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	s, ok := t.m[client]
+	if !ok || now.Sub(s.since) > t.window {
+		if ok && now.Before(s.until) {
+			return
+		}
+		s = &banState{since: now}
+		t.m[client] = s
+	}
+	if s.failures++; s.failures == t.failures {
+		s.until = now.Add(t.duration)
+		countMetric("bans")
+		log.Println("banned", client, "until", s.until.Format(time.RFC3339))
+	}
+}
+
+func (t *banTable) banned(client string, now time.Time) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	s, ok := t.m[client]
+	return ok && now.Before(s.until)
+}
+
+// banStatus is a banned client as reported by the admin API
+type banStatus struct {
+	IP       string    `json:"ip"`
+	Failures int       `json:"failures"`
+	Until    time.Time `json:"until"`
+}
+
+// list returns the clients banned, ordered by IP
+func (t *banTable) list(now time.Time) []banStatus {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	l := []banStatus{}
+	for ip, s := range t.m {
+		if now.Before(s.until) {
+			l = append(l, banStatus{ip, s.failures, s.until})
+		}
+	}
+	sort.Slice(l, func(i, j int) bool { return l[i].IP < l[j].IP })
+	return l
+}
+
+// sweep forgets the expired bans and windows
+func (t *banTable) sweep(now time.Time) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for ip, s := range t.m {
+		if now.After(s.until) && now.Sub(s.since) > t.window {
+			delete(t.m, ip)
+		}
+	}
+}
+
+func sweepBans(t *banTable) {
+	for range time.Tick(_limiterSweepEvery) {
+		t.sweep(time.Now())
+	}
+}
+
+func serveAdminBans(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, _bans.list(time.Now()))
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestBadTokenCache(t *testing.T) {
+	token := []byte("0123456789abcdef0123456789abcdef")
+	if _, err := backendAddrDecrypt(token); err == nil || err == errBadToken {
+		t.Fatalf("unexpected error %v", err)
+	}
+	hits := metricValue("bad_token_hits")
+	if _, err := backendAddrDecrypt(token); err != errBadToken {
+		t.Fatalf("bad token decrypted again: %v", err)
+	}
+	if metricValue("bad_token_hits") != hits+1 {
+		t.Fatal("hit not counted")
+	}
+}
+
+func TestDecryptGate(t *testing.T) {
+	_decryptGate.configure(1, 0, 0)
+	defer _decryptGate.configure(0, 0, 0)
+
+	b, err := encryptText([]byte("127.0.0.1:62867"), _secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := _decryptGate.acquire(); err != nil {
+		t.Fatal(err)
+	}
+	testProtocol(append(b, '\n'), []byte("4111"))
+	_decryptGate.release()
+
+	// busy is no bad token
+	if _, err := cipherAddrDecrypt(b); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestDecryptBan(t *testing.T) {
+	bans := newBanTable(3, time.Minute, time.Minute)
+	addr, stop := startListener(t, &listener{bans: bans})
+	defer stop()
+	reply := func(b []byte) string {
+		conn, err := net.Dial("tcp", addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		conn.SetDeadline(time.Now().Add(time.Second * 5))
+		conn.Write(b)
+		got, _ := ioutil.ReadAll(conn)
+		return string(got)
+	}
+
+	bad := append([]byte("MjF3MjE="), '\n')
+	failures := metricValue("decrypt_failures")
+	for i := 0; i < 3; i++ {
+		if got := reply(bad); got != "4106" {
+			t.Fatalf("expected 4106, got %q", got)
+		}
+	}
+	if metricValue("decrypt_failures") != failures+3 {
+		t.Fatal("failures not counted")
+	}
+
+	b, err := encryptText(_echoServerAddr, _secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rejected := metricValue("ban_rejected")
+	if got := reply(append(b, '\n')); got != "4100" {
+		t.Fatalf("expected 4100, got %q", got)
+	}
+	if metricValue("ban_rejected") != rejected+1 {
+		t.Fatal("rejection not counted")
+	}
+	// other listeners keep their own bans
+	testProtocol(append(b, '\n'), nil)
+
+	l := bans.list(time.Now())
+	if len(l) != 1 || l[0].IP != "127.0.0.1" || l[0].Failures != 3 {
+		t.Fatalf("unexpected bans %+v", l)
+	}
+	w := httptest.NewRecorder()
+	serveAdminBans(w, httptest.NewRequest("GET", "/admin/bans", nil))
+	var admin []banStatus
+	if err := json.Unmarshal(w.Body.Bytes(), &admin); err != nil || len(admin) != 0 {
+		t.Fatalf("unexpected bans of the main port %+v %v", admin, err)
+	}
+}
+
+func TestBanExpiry(t *testing.T) {
+	bans := newBanTable(2, time.Minute, time.Minute)
+	now := time.Now()
+
+	// failures spread over more than a window do not add up
+	bans.fail("10.0.0.1", now)
+	bans.fail("10.0.0.1", now.Add(time.Minute*2))
+	if bans.banned("10.0.0.1", now.Add(time.Minute*2)) {
+		t.Fatal("banned for failures in different windows")
+	}
+
+	bans.fail("10.0.0.1", now.Add(time.Minute*3))
+	if !bans.banned("10.0.0.1", now.Add(time.Minute*3)) {
+		t.Fatal("not banned")
+	}
+	// a new window does not lift the ban early
+	bans.fail("10.0.0.1", now.Add(time.Minute*3+time.Second*59))
+	if !bans.banned("10.0.0.1", now.Add(time.Minute*3+time.Second*59)) {
+		t.Fatal("ban lifted early")
+	}
+	if bans.banned("10.0.0.1", now.Add(time.Minute*5)) {
+		t.Fatal("ban not lifted")
+	}
+
+	bans.sweep(now.Add(time.Minute * 5))
+	if len(bans.m) != 0 {
+		t.Fatalf("%d entries left", len(bans.m))
+	}
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"net"
+	"sync/atomic"
+	"time"
+)
+
+// halfClose is shared by the two directions of a tunnel. Once one of them
+// has reached EOF, the other one goes on until its own EOF, or until it has
+// been idle for timeout.
+type halfClose struct {
+	ended   int32
+	timeout time.Duration
+}
+
+func (h *halfClose) halfClosed() bool {
+	return atomic.LoadInt32(&h.ended) > 0
+}
+
+// readDeadline is the deadline of the next wait for data of a direction
+func (h *halfClose) readDeadline() time.Time {
+	if h.halfClosed() {
+		return time.Now().Add(h.timeout)
+	}
+	return time.Now().Add(_ConnReadTimeout)
+}
+
+// expired tells if a direction which timed out, having had data last at
+// last, is to be given up
+func (h *halfClose) expired(last time.Time) bool {
+	return h.halfClosed() && time.Since(last) >= h.timeout
+}
+
+// end is called by a direction done with err, nil at EOF. The EOF is passed
+// on by shutting down the write side of dstconn.
+func (h *halfClose) end(dstconn, srcconn net.Conn, err error) {
+	if err != nil {
+		dstconn.Close()
+		srcconn.Close()
+		return
+	}
+	if closeWrite(dstconn) != nil {
+		dstconn.Close()
+		return
+	}
+	if atomic.AddInt32(&h.ended, 1) == 1 {
+		countMetric("relay_half_closed")
+		// the reverse direction waits for data from dstconn, wake it up to
+		// apply the half-close timeout
+		dstconn.SetReadDeadline(time.Now().Add(h.timeout))
+	}
+}
+
+// closeWrite shuts down the write side of c, or closes c if it cannot
+func closeWrite(c net.Conn) error {
+	if cw, ok := c.(interface{ CloseWrite() error }); ok {
+		return cw.CloseWrite()
+	}
+	if tcp := tcpConnOf(c); tcp != nil {
+		return tcp.CloseWrite()
+	}
+	return c.Close()
+}
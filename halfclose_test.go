@@ -0,0 +1,112 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"testing"
+	"time"
+)
+
+// newRequestServer answers every connection with the size of the request
+// once the client half-closed it, or with nothing if silent
+func newRequestServer(silent bool) net.Listener {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		panic(err)
+	}
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer c.Close()
+				b, err := ioutil.ReadAll(c)
+				if err != nil {
+					return
+				}
+				if silent {
+					// leaves it to the half-close timeout of the tunnel
+					time.Sleep(time.Second * 5)
+					return
+				}
+				fmt.Fprintf(c, "%d bytes", len(b))
+			}()
+		}
+	}()
+	return l
+}
+
+// halfCloseRequest sends a request to the backend of l through frontd at
+// addr, half closes the connection and returns the response
+func halfCloseRequest(t *testing.T, addr string, l net.Listener, req []byte) []byte {
+	b, err := encryptText([]byte(l.Addr().String()), _secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(time.Second * 10))
+	conn.Write(append(append(b, '\n'), req...))
+	if err := conn.(*net.TCPConn).CloseWrite(); err != nil {
+		t.Fatal(err)
+	}
+	resp, err := ioutil.ReadAll(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp
+}
+
+// testHalfClose tunnels half-closed requests through a listener relaying as
+// relay does, with a timeout of its own
+func testHalfClose(t *testing.T, relay relayConfig) {
+	relay.halfCloseTimeout = time.Minute
+	addr, stop := startListener(t, &listener{relay: &relay})
+	defer stop()
+	l := newRequestServer(false)
+	defer l.Close()
+	halfClosed := metricValue("relay_half_closed")
+	req := bytes.Repeat([]byte("x"), 1<<20)
+	if resp := halfCloseRequest(t, addr, l, req); string(resp) != fmt.Sprintf("%d bytes", len(req)) {
+		t.Fatalf("unexpected response %q", resp)
+	}
+	// other tests' tunnels may end meanwhile
+	if metricValue("relay_half_closed") <= halfClosed {
+		t.Fatal("half-close not counted")
+	}
+
+	// no response, the tunnel is closed once idle
+	relay.halfCloseTimeout = time.Millisecond * 200
+	addr, stop = startListener(t, &listener{relay: &relay})
+	defer stop()
+	silent := newRequestServer(true)
+	defer silent.Close()
+	start := time.Now()
+	if resp := halfCloseRequest(t, addr, silent, []byte("ping")); len(resp) != 0 {
+		t.Fatalf("unexpected response %q", resp)
+	}
+	if d := time.Since(start); d < relay.halfCloseTimeout || d > time.Second*5 {
+		t.Fatalf("half-closed tunnel closed after %v", d)
+	}
+}
+
+func TestHalfClose(t *testing.T) {
+	for _, splice := range []bool{true, false} {
+		testHalfClose(t, relayConfig{splice: splice})
+	}
+}
+
+func TestRelayHalfClose(t *testing.T) {
+	e, err := newRelayEngine(1, time.Millisecond*20)
+	if err != nil {
+		t.Skip(err)
+	}
+	testHalfClose(t, relayConfig{engine: e})
+}
@@ -0,0 +1,235 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"expvar"
+	"io"
+	"net"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+var errUnhealthy = errors.New("backend unhealthy")
+
+var (
+	// how often backends are checked, 0 disables health checks
+	_HealthCheckInterval time.Duration
+	_HealthCheckTimeout  = time.Second * 2
+	// sent once connected, the reply has to start with _HealthCheckExpect.
+	// Without them a check is a plain TCP connect.
+	_HealthCheckSend   []byte
+	_HealthCheckExpect []byte
+	// consecutive failed checks making a backend unhealthy, and successful
+	// ones making it healthy again
+	_HealthCheckFall = 3
+	_HealthCheckRise = 2
+
+	// backends not dialed or routed to for this long are no longer checked
+	_healthForget = time.Minute * 10
+	// concurrent checks
+	_healthCheckers = 64
+
+	_health = &healthTable{m: make(map[string]*healthState)}
+)
+
+// healthState is the health of a backend as seen by the checks
+type healthState struct {
+	Healthy   bool      `json:"healthy"`
+	LastCheck time.Time `json:"last_check"`
+	LastError string    `json:"last_error,omitempty"`
+
+	successes int
+	failures  int
+	lastSeen  time.Time
+}
+
+// healthTable holds the health of the backends checked. Backends never
+// checked are healthy.
+type healthTable struct {
+	mu sync.Mutex
+	m  map[string]*healthState
+}
+
+func init() {
+	_metrics.Set("health_unhealthy", expvar.Func(func() interface{} {
+		return _health.unhealthy()
+	}))
+	http.HandleFunc("/admin/health", serveAdminHealth)
+}
+
+func (h *healthTable) healthy(addr string) bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	s, ok := h.m[addr]
+	return !ok || s.Healthy
+}
+
+// filterHealthy returns the healthy ones of addrs
+func (h *healthTable) filterHealthy(addrs []string) []string {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if len(h.m) == 0 {
+		return addrs
+	}
+	healthy := make([]string, 0, len(addrs))
+	for _, addr := range addrs {
+		if s, ok := h.m[addr]; !ok || s.Healthy {
+			healthy = append(healthy, addr)
+		}
+	}
+	return healthy
+}
+
+// unhealthy returns the unhealthy backends, ordered
+func (h *healthTable) unhealthy() []string {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	addrs := []string{}
+	for addr, s := range h.m {
+		if !s.Healthy {
+			addrs = append(addrs, addr)
+		}
+	}
+	sort.Strings(addrs)
+	return addrs
+}
+
+// report records the result of a check
+func (h *healthTable) report(addr string, err error, now time.Time) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	s, ok := h.m[addr]
+	if !ok {
+		return
+	}
+	s.LastCheck = now
+	if err == nil {
+		s.LastError = ""
+		s.failures = 0
+		if s.successes++; !s.Healthy && s.successes >= _HealthCheckRise {
+			s.Healthy = true
+			countMetric("health_recovered")
+		}
+		return
+	}
+	s.LastError = err.Error()
+	s.successes = 0
+	if s.failures++; s.Healthy && s.failures >= _HealthCheckFall {
+		s.Healthy = false
+		countMetric("health_failed")
+	}
+}
+
+// track starts checking addrs, and forgets the backends not among them for
+// _healthForget. It returns the backends to check.
+func (h *healthTable) track(addrs []string, now time.Time) []string {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for _, addr := range addrs {
+		s, ok := h.m[addr]
+		if !ok {
+			s = &healthState{Healthy: true}
+			h.m[addr] = s
+		}
+		s.lastSeen = now
+	}
+	tracked := make([]string, 0, len(h.m))
+	for addr, s := range h.m {
+		if now.Sub(s.lastSeen) > _healthForget {
+			delete(h.m, addr)
+			continue
+		}
+		tracked = append(tracked, addr)
+	}
+	return tracked
+}
+
+// checkedBackends returns the backends in use and the addresses of the route
+// table
+func checkedBackends() []string {
+	var addrs []string
+	_backends.mu.Lock()
+	for addr := range _backends.m {
+		addrs = append(addrs, addr)
+	}
+	_backends.mu.Unlock()
+
+	for _, target := range _routes.Load().(routeTable) {
+		if !isMultiTarget(target) {
+			addrs = append(addrs, target)
+			continue
+		}
+		// addresses resolved elsewhere are checked once in use
+		t, err := parseBackendTarget(target)
+		if err != nil || len(t.scheme) > 0 {
+			continue
+		}
+		if expanded, err := expandHosts(t.addrs); err == nil {
+			addrs = append(addrs, expanded...)
+		}
+	}
+	return addrs
+}
+
+// checkBackend connects to a backend, and if configured, sends the probe and
+// reads the reply expected
+func checkBackend(addr string) error {
+	conn, err := net.DialTimeout("tcp", addr, _HealthCheckTimeout)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	if len(_HealthCheckSend) == 0 && len(_HealthCheckExpect) == 0 {
+		return nil
+	}
+
+	conn.SetDeadline(time.Now().Add(_HealthCheckTimeout))
+	if len(_HealthCheckSend) > 0 {
+		if _, err := conn.Write(_HealthCheckSend); err != nil {
+			return err
+		}
+	}
+	if len(_HealthCheckExpect) > 0 {
+		reply := make([]byte, len(_HealthCheckExpect))
+		if _, err := io.ReadFull(conn, reply); err != nil {
+			return err
+		}
+		if !bytes.Equal(reply, _HealthCheckExpect) {
+			return errors.New("unexpected health check reply")
+		}
+	}
+	return nil
+}
+
+// runHealthChecks checks the backends every _HealthCheckInterval
+func runHealthChecks() {
+	sem := make(chan struct{}, _healthCheckers)
+	for range time.Tick(_HealthCheckInterval) {
+		var wg sync.WaitGroup
+		for _, addr := range _health.track(checkedBackends(), time.Now()) {
+			wg.Add(1)
+			sem <- struct{}{}
+			go func(addr string) {
+				defer func() {
+					<-sem
+					wg.Done()
+				}()
+				_health.report(addr, checkBackend(addr), time.Now())
+			}(addr)
+		}
+		wg.Wait()
+	}
+}
+
+func serveAdminHealth(w http.ResponseWriter, r *http.Request) {
+	_health.mu.Lock()
+	m := make(map[string]healthState, len(_health.m))
+	for addr, s := range _health.m {
+		m[addr] = *s
+	}
+	_health.mu.Unlock()
+	writeJSON(w, m)
+}
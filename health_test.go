@@ -0,0 +1,116 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestHealthTable(t *testing.T) {
+	_healthForget = time.Minute
+	defer func() { _healthForget = time.Minute * 10 }()
+
+	h := &healthTable{m: make(map[string]*healthState)}
+	now := time.Now()
+	if tracked := h.track([]string{"a", "b"}, now); len(tracked) != 2 {
+		t.Fatalf("tracking %v", tracked)
+	}
+
+	failure := errors.New("refused")
+	for i := 0; i < _HealthCheckFall; i++ {
+		if !h.healthy("a") {
+			t.Fatalf("unhealthy after %d failures", i)
+		}
+		h.report("a", failure, now)
+	}
+	if h.healthy("a") || !h.healthy("b") || !h.healthy("unknown") {
+		t.Fatal("unexpected health")
+	}
+	if addrs := h.filterHealthy([]string{"a", "b", "c"}); len(addrs) != 2 || addrs[0] != "b" {
+		t.Fatalf("unexpected healthy backends %v", addrs)
+	}
+
+	for i := 0; i < _HealthCheckRise; i++ {
+		if h.healthy("a") {
+			t.Fatalf("healthy after %d successes", i)
+		}
+		h.report("a", nil, now)
+	}
+	if !h.healthy("a") {
+		t.Fatal("not recovered")
+	}
+
+	// forgotten once no longer in use
+	if tracked := h.track([]string{"b"}, now.Add(time.Minute*2)); len(tracked) != 1 || tracked[0] != "b" {
+		t.Fatalf("tracking %v", tracked)
+	}
+}
+
+func TestCheckBackend(t *testing.T) {
+	defer func() { _HealthCheckSend, _HealthCheckExpect = nil, nil }()
+
+	if err := checkBackend(string(_echoServerAddr)); err != nil {
+		t.Fatal(err)
+	}
+	if err := checkBackend("127.0.0.1:62868"); err == nil {
+		t.Fatal("nothing listens there")
+	}
+
+	_HealthCheckSend, _HealthCheckExpect = []byte("ping"), []byte("ping")
+	if err := checkBackend(string(_echoServerAddr)); err != nil {
+		t.Fatal(err)
+	}
+	_HealthCheckExpect = []byte("pong")
+	if err := checkBackend(string(_echoServerAddr)); err == nil {
+		t.Fatal("unexpected reply accepted")
+	}
+}
+
+func TestUnhealthyBackend(t *testing.T) {
+	h := _health
+	_health = &healthTable{m: make(map[string]*healthState)}
+	defer func() { _health = h }()
+
+	// the backend listens but is marked unhealthy
+	unhealthy := string(_httpServerAddr)
+	_health.track([]string{unhealthy}, time.Now())
+	for i := 0; i < _HealthCheckFall; i++ {
+		_health.report(unhealthy, errors.New("unexpected reply"), time.Now())
+	}
+
+	b, err := encryptText([]byte(unhealthy), _secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testProtocol(append(b, '\n'), []byte("4102"))
+
+	// skipped without a failover
+	failovers := metricValue("backend_failover")
+	b, err = encryptText([]byte(unhealthy+","+string(_echoServerAddr)+"?lb=first"), _secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := net.Dial("tcp", _defaultFrontdAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Write(append(b, '\n'))
+	testEchoRound(conn)
+	conn.Close()
+	if metricValue("backend_failover") != failovers {
+		t.Fatal("unhealthy backend dialed")
+	}
+
+	w := httptest.NewRecorder()
+	serveAdminHealth(w, httptest.NewRequest("GET", "/admin/health", nil))
+	var status map[string]healthState
+	if err := json.Unmarshal(w.Body.Bytes(), &status); err != nil {
+		t.Fatal(err)
+	}
+	if s := status[unhealthy]; s.Healthy || s.LastError != "unexpected reply" {
+		t.Fatalf("unexpected status %+v", status)
+	}
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"strings"
+	"time"
+
+	"golang.org/x/net/http2"
+)
+
+var (
+	// TLS is terminated when a certificate is configured
+	_TLSConfig *tls.Config
+
+	_h2Server    = &http2.Server{}
+	_h2Transport = &http.Transport{
+		DialContext:         dialHTTPBackend,
+		MaxIdleConnsPerHost: 64,
+		IdleConnTimeout:     time.Minute,
+	}
+	_h2Proxy = &httputil.ReverseProxy{
+		Rewrite:      rewriteHTTP2Request,
+		Transport:    _h2Transport,
+		ErrorHandler: handleHTTP2ProxyError,
+	}
+)
+
+// backendError carries the error code of a failed backend dial through
+// net/http
+type backendError struct {
+	errCode []byte
+	err     error
+}
+
+func (e *backendError) Error() string {
+	return string(e.errCode) + ": " + e.err.Error()
+}
+
+// bufferedConn reads through the bufio.Reader which sniffed the protocol
+// until that has nothing buffered anymore, then it gives the reader back by
+// done and reads the connection directly
+type bufferedConn struct {
+	net.Conn
+	rdr  *bufio.Reader
+	done func()
+}
+
+func (c *bufferedConn) Read(p []byte) (int, error) {
+	if c.rdr != nil {
+		if c.rdr.Buffered() > 0 {
+			return c.rdr.Read(p)
+		}
+		c.rdr = nil
+		c.done()
+	}
+	return c.Conn.Read(p)
+}
+
+func loadTLSConfig(certFile, keyFile string) (*tls.Config, error) {
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+	return &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		NextProtos:   []string{http2.NextProtoTLS, "http/1.1"},
+	}, nil
+}
+
+// serveHTTP2 serves an HTTP/2 connection, every stream is routed by its own
+// x-cipher-origin header
+func serveHTTP2(c net.Conn, bans *banTable, backends *backendTable) {
+	// HTTP/2 keeps track of idle connections on its own
+	c.SetReadDeadline(time.Time{})
+	_h2Server.ServeConn(c, &http2.ServeConnOpts{
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			serveHTTP2Stream(w, r, bans, backends)
+		}),
+	})
+}
+
+type ctxKeyBackendAddr struct{}
+
+// h2Route is where a stream goes, kept in its context under ctxKeyBackendAddr
+type h2Route struct {
+	// mapped by mapTarget
+	target string
+	// IP address of the client
+	client string
+	// dialing the backends
+	backends *backendTable
+}
+
+func serveHTTP2Stream(w http.ResponseWriter, r *http.Request, bans *banTable, backends *backendTable) {
+	cipherAddr := r.Header.Get(string(_hdrCipherOrigin))
+	if len(cipherAddr) == 0 {
+		writeHTTPErrCode(w, []byte("4108"))
+		return
+	}
+	client := ipAddrFromRemoteAddr(r.RemoteAddr)
+	if bans.isBanned(client) {
+		writeHTTPErrCode(w, []byte("4100"))
+		return
+	}
+	addr, err := cipherAddrDecrypt([]byte(cipherAddr))
+	if err != nil {
+		writeHTTPErrCode(w, bans.decryptFailed(client, err))
+		return
+	}
+
+	route := h2Route{mapTarget(string(addr), client), client, backends}
+	ctx := context.WithValue(r.Context(), ctxKeyBackendAddr{}, route)
+	_h2Proxy.ServeHTTP(w, r.WithContext(ctx))
+}
+
+// rewriteHTTP2Request points the request to its backend and records the
+// client address the same way handleHTTPHdr does
+func rewriteHTTP2Request(pr *httputil.ProxyRequest) {
+	route := pr.In.Context().Value(ctxKeyBackendAddr{}).(h2Route)
+	pr.Out.URL.Scheme = "http"
+	pr.Out.URL.Host = route.target
+	if isMultiTarget(route.target) {
+		// a host name of its own keeps the connections to the backends of
+		// one target in a pool of their own. With lb=hash the backend
+		// depends on the client, so each client gets a pool of its own.
+		key := hashString(route.target)
+		if t, err := parseBackendTarget(route.target); err == nil && t.strategy == lbHash {
+			key = hashString(route.target, "|", route.client)
+		}
+		pr.Out.URL.Host = fmt.Sprintf("target-%x", key)
+	}
+	pr.Out.Host = pr.In.Host
+	pr.Out.Header.Del(string(_hdrCipherOrigin))
+
+	xff := ipAddrFromRemoteAddr(pr.In.RemoteAddr)
+	if prior, ok := pr.In.Header["X-Forwarded-For"]; ok {
+		xff = xff + ", " + strings.Join(prior, ", ")
+	}
+	pr.Out.Header.Set("X-Forwarded-For", xff)
+}
+
+func dialHTTPBackend(ctx context.Context, network, addr string) (net.Conn, error) {
+	var backend net.Conn
+	var errCode []byte
+	var err error
+	if route, ok := ctx.Value(ctxKeyBackendAddr{}).(h2Route); ok {
+		backend, errCode, err = route.backends.dialBackends(route.target, route.client)
+	} else {
+		backend, errCode, err = _backends.dialBackend(addr)
+	}
+	if err != nil {
+		return nil, &backendError{errCode, err}
+	}
+	return backend, nil
+}
+
+func handleHTTP2ProxyError(w http.ResponseWriter, r *http.Request, err error) {
+	var be *backendError
+	if errors.As(err, &be) {
+		writeHTTPErrCode(w, be.errCode)
+	} else {
+		writeHTTPErrCode(w, []byte("4102"))
+	}
+	log.Println(err)
+}
+
+// writeHTTPErrCode is writeErrCode for net/http handlers
+func writeHTTPErrCode(w http.ResponseWriter, errCode []byte) {
+	status, ok := _httpStatusByErrCode[string(errCode)]
+	if !ok {
+		status = http.StatusBadGateway
+	}
+	w.Header().Set("Content-Type", "text/plain")
+	w.WriteHeader(status)
+	fmt.Fprintf(w, "%s", errCode)
+}
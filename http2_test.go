@@ -0,0 +1,156 @@
+package main
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	"golang.org/x/net/http2"
+)
+
+func testTLSConfig() *tls.Config {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		panic(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "frontd"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		DNSNames:     []string{"frontd"},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		panic(err)
+	}
+	return &tls.Config{
+		Certificates: []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: key}},
+		NextProtos:   []string{http2.NextProtoTLS, "http/1.1"},
+	}
+}
+
+func testHTTPGet(t *testing.T, client *http.Client, url, cipherAddr string, status int, expected string) {
+	req, _ := http.NewRequest("GET", url, nil)
+	if len(cipherAddr) > 0 {
+		req.Header.Set("X-Cipher-Origin", cipherAddr)
+	}
+	res, err := client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	b, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.StatusCode != status || string(b) != expected {
+		t.Fatalf("http reply not match: %d %q, expected %d %q", res.StatusCode, b, status, expected)
+	}
+}
+
+func TestHTTP2Cleartext(t *testing.T) {
+	a, cipherA := newTestBackend("A")
+	defer a.Close()
+	b, cipherB := newTestBackend("B")
+	defer b.Close()
+	cipherBlackHole, err := encryptText(_blackHoleServerAddr, _secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tr := &http2.Transport{
+		AllowHTTP: true,
+		DialTLSContext: func(ctx context.Context, network, addr string, cfg *tls.Config) (net.Conn, error) {
+			return net.Dial(network, addr)
+		},
+	}
+	defer tr.CloseIdleConnections()
+	client := &http.Client{Transport: tr, Timeout: time.Second * 5}
+
+	url := "http://" + _defaultFrontdAddr + "/"
+	// streams of one connection go to different backends
+	testHTTPGet(t, client, url, cipherA, http.StatusOK, "A|127.0.0.1|")
+	testHTTPGet(t, client, url, cipherB, http.StatusOK, "B|127.0.0.1|")
+	testHTTPGet(t, client, url, "", http.StatusBadRequest, "4108")
+	testHTTPGet(t, client, url, "MjF3MjE=", http.StatusForbidden, "4106")
+	testHTTPGet(t, client, url, string(cipherBlackHole), http.StatusBadGateway, "4102")
+}
+
+func TestHTTP2TLS(t *testing.T) {
+	addr, stop := startListener(t, &listener{tlsConfig: testTLSConfig()})
+	defer stop()
+
+	a, cipherA := newTestBackend("A")
+	defer a.Close()
+
+	url := "https://" + addr + "/"
+
+	h2 := &http2.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}}
+	defer h2.CloseIdleConnections()
+	testHTTPGet(t, &http.Client{Transport: h2, Timeout: time.Second * 5}, url, cipherA, http.StatusOK, "A|127.0.0.1|")
+
+	// HTTP/1.1 over TLS
+	h1 := &http.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}}
+	defer h1.CloseIdleConnections()
+	testHTTPGet(t, &http.Client{Transport: h1, Timeout: time.Second * 5}, url, cipherA, http.StatusOK, "A|127.0.0.1|")
+}
+
+func TestHTTP2HashAffinity(t *testing.T) {
+	a, _ := newTestBackend("A")
+	defer a.Close()
+	b, _ := newTestBackend("B")
+	defer b.Close()
+	addrA, addrB := a.Listener.Addr().String(), b.Listener.Addr().String()
+	target := addrA + "," + addrB + "?lb=hash"
+	cipher, err := encryptText([]byte(target), _secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// two loopback clients hashed to different backends
+	tg, _ := parseBackendTarget(target)
+	clients := map[string]string{}
+	for i := 1; i < 64 && len(clients) < 2; i++ {
+		ip := fmt.Sprintf("127.0.0.%d", i)
+		name := "A"
+		if tg.order(tg.addrs, ip, _backends)[0] == addrB {
+			name = "B"
+		}
+		if _, ok := clients[name]; !ok {
+			clients[name] = ip
+		}
+	}
+	if len(clients) < 2 {
+		t.Fatal("no clients for both backends")
+	}
+
+	url := "http://" + _defaultFrontdAddr + "/"
+	for i := 0; i < 2; i++ {
+		for _, name := range []string{"A", "B"} {
+			ip := clients[name]
+			dialer := &net.Dialer{LocalAddr: &net.TCPAddr{IP: net.ParseIP(ip)}}
+			tr := &http2.Transport{
+				AllowHTTP: true,
+				DialTLSContext: func(ctx context.Context, network, addr string, cfg *tls.Config) (net.Conn, error) {
+					return dialer.DialContext(ctx, network, addr)
+				},
+			}
+			// the backend connections of the first client are pooled
+			// when the second one asks
+			testHTTPGet(t, &http.Client{Transport: tr, Timeout: time.Second * 5}, url, string(cipher), http.StatusOK, name+"|"+ip+"|")
+			tr.CloseIdleConnections()
+		}
+	}
+}
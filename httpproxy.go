@@ -0,0 +1,208 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"math"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// httpBackend is a keep-alive connection to one backend of a client connection
+type httpBackend struct {
+	conn  net.Conn
+	rdr   *bufio.Reader
+	fresh bool
+}
+
+// serveHTTPProxy reverse proxies an HTTP/1.x connection request by request.
+// Every request is routed by its own X-Cipher-Origin header, so requests
+// on one keep-alive connection may reach different backends. Requests are
+// answered in order, which also takes care of pipelining. The backends are
+// dialed through table, WebSocket handshakes for wsBridgePath are bridged.
+func serveHTTPProxy(rdr *bufio.Reader, c net.Conn, bans *banTable, relay *relayConfig, table *backendTable, wsBridgePath string) error {
+	backends := make(map[string]*httpBackend)
+	defer func() {
+		for _, b := range backends {
+			b.conn.Close()
+		}
+	}()
+
+	// the header of a request is read through hdrLimit, which holds it to
+	// _maxHTTPHeaderSize along with what rdr has buffered of it already
+	hdrLimit := &io.LimitedReader{R: c}
+	refill(rdr, rdr, hdrLimit)
+
+	for {
+		c.SetReadDeadline(time.Now().Add(_ConnReadTimeout))
+		hdrLimit.N = int64(_maxHTTPHeaderSize - rdr.Buffered())
+		req, err := http.ReadRequest(rdr)
+		overflowed := hdrLimit.N <= 0
+		hdrLimit.N = math.MaxInt64
+		if err != nil {
+			if overflowed {
+				writeErrCode(c, []byte("4108"), true)
+				return errors.New("http header size overflowed")
+			}
+			if err == io.EOF {
+				return nil
+			}
+			if ne, ok := err.(net.Error); ok && ne.Timeout() {
+				// idle keep-alive connection
+				return nil
+			}
+			writeErrCode(c, []byte("4107"), true)
+			return err
+		}
+
+		cipherAddr := req.Header.Get(string(_hdrCipherOrigin))
+		var wsProtocol string
+		if len(cipherAddr) == 0 && strings.EqualFold(req.Header.Get("Upgrade"), "websocket") {
+			cipherAddr, wsProtocol, err = prepareWebSocketRequest(req)
+			if err != nil {
+				writeErrCode(c, []byte("4107"), true)
+				return err
+			}
+		}
+		if len(cipherAddr) == 0 {
+			writeErrCode(c, []byte("4108"), true)
+			return errors.New("empty http cipher address header")
+		}
+		addr, err := cipherAddrDecrypt([]byte(cipherAddr))
+		if err != nil {
+			writeErrCode(c, bans.decryptFailed(ipAddrFromRemoteAddr(c.RemoteAddr().String()), err), true)
+			return err
+		}
+
+		if strings.EqualFold(req.Header.Get("Upgrade"), "websocket") && isWebSocketBridge(req.URL.RequestURI(), wsBridgePath) {
+			if len(wsProtocol) == 0 {
+				wsProtocol = strings.TrimSpace(strings.Split(req.Header.Get("Sec-WebSocket-Protocol"), ",")[0])
+			}
+			return bridgeWebSocket(string(addr), rdr, c, req.Header.Get("Sec-WebSocket-Key"), wsProtocol, relay, table)
+		}
+
+		prepareProxyRequest(req, c)
+
+		resp, b, errCode, err := roundTrip(table, backends, string(addr), ipAddrFromRemoteAddr(c.RemoteAddr().String()), req)
+		if err != nil {
+			writeErrCode(c, errCode, true)
+			return err
+		}
+
+		// 1xx informational responses are followed by the final one
+		for resp.StatusCode >= 100 && resp.StatusCode < 200 && resp.StatusCode != http.StatusSwitchingProtocols {
+			resp.Write(c)
+			resp, err = http.ReadResponse(b.rdr, req)
+			if err != nil {
+				delete(backends, string(addr))
+				b.conn.Close()
+				writeErrCode(c, []byte("4102"), true)
+				return err
+			}
+		}
+
+		if resp.StatusCode == http.StatusSwitchingProtocols {
+			// the connection now belongs to the upgraded protocol
+			delete(backends, string(addr))
+			if len(wsProtocol) > 0 && len(resp.Header.Get("Sec-WebSocket-Protocol")) == 0 {
+				resp.Header.Set("Sec-WebSocket-Protocol", wsProtocol)
+			}
+			if err := resp.Write(c); err != nil {
+				b.conn.Close()
+				return err
+			}
+			pipeBoth(c, rdr, b.conn, b.rdr, relay)
+			return nil
+		}
+
+		err = resp.Write(c)
+		resp.Body.Close()
+		if err != nil {
+			return err
+		}
+
+		if resp.Close {
+			delete(backends, string(addr))
+			b.conn.Close()
+		}
+		if req.Close || resp.Close {
+			return nil
+		}
+	}
+}
+
+// prepareProxyRequest strips the cipher address and records the client
+// address the same way handleHTTPHdr does
+func prepareProxyRequest(req *http.Request, c net.Conn) {
+	req.Header.Del(string(_hdrCipherOrigin))
+
+	xff := ipAddrFromRemoteAddr(c.RemoteAddr().String())
+	if prior, ok := req.Header["X-Forwarded-For"]; ok {
+		xff = xff + ", " + strings.Join(prior, ", ")
+	}
+	req.Header.Set("X-Forwarded-For", xff)
+
+	// keep Request.Write from adding its own User-Agent
+	if _, ok := req.Header["User-Agent"]; !ok {
+		req.Header["User-Agent"] = []string{""}
+	}
+}
+
+// prepareWebSocketRequest takes the cipher address out of the URL or the
+// subprotocols of a WebSocket handshake, see websocketCipher
+func prepareWebSocketRequest(req *http.Request) (cipherAddr, wsProtocol string, err error) {
+	protocols := strings.Join(req.Header["Sec-Websocket-Protocol"], ", ")
+	b, target, protocols, wsProtocol := websocketCipher(req.RequestURI, protocols)
+	if len(b) == 0 {
+		return "", "", nil
+	}
+
+	req.URL, err = url.ParseRequestURI(target)
+	if err != nil {
+		return "", "", err
+	}
+	if len(protocols) > 0 {
+		req.Header.Set("Sec-WebSocket-Protocol", protocols)
+	} else {
+		req.Header.Del("Sec-WebSocket-Protocol")
+	}
+	return string(b), wsProtocol, nil
+}
+
+// roundTrip sends req to addr over a kept-alive backend connection, dialing
+// one through table if needed. client is the IP address of the client.
+func roundTrip(table *backendTable, backends map[string]*httpBackend, addr, client string, req *http.Request) (*http.Response, *httpBackend, []byte, error) {
+	for {
+		b, ok := backends[addr]
+		if !ok {
+			conn, errCode, err := table.dialTarget(addr, client)
+			if err != nil {
+				return nil, nil, errCode, err
+			}
+			b = &httpBackend{conn: conn, rdr: bufio.NewReader(conn), fresh: true}
+			backends[addr] = b
+		}
+
+		err := req.Write(b.conn)
+		var resp *http.Response
+		if err == nil {
+			resp, err = http.ReadResponse(b.rdr, req)
+		}
+		if err == nil {
+			b.fresh = false
+			return resp, b, nil, nil
+		}
+
+		delete(backends, addr)
+		b.conn.Close()
+		// the backend may have closed an idle connection, retry once on a
+		// new one as long as no request body has been consumed
+		if b.fresh || req.Body != http.NoBody {
+			return nil, nil, []byte("4102"), err
+		}
+	}
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newTestBackend(name string) (*httptest.Server, string) {
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		fmt.Fprintf(w, "%s|%s|%s", name, r.Header.Get("X-Forwarded-For"), body)
+	}))
+	cipherAddr, err := encryptText([]byte(strings.TrimPrefix(s.URL, "http://")), _secret)
+	if err != nil {
+		panic(err)
+	}
+	return s, string(cipherAddr)
+}
+
+func TestHTTPPerRequest(t *testing.T) {
+	frontd, stop := startListener(t, &listener{httpPerRequest: true})
+	defer stop()
+
+	a, cipherA := newTestBackend("A")
+	defer a.Close()
+	b, cipherB := newTestBackend("B")
+	defer b.Close()
+
+	conn, err := net.Dial("tcp", frontd)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(time.Second * 5))
+
+	// three pipelined requests on one connection, the second one chunked
+	fmt.Fprintf(conn, "GET / HTTP/1.1\r\nHost: a\r\nX-Cipher-Origin: %s\r\nX-Forwarded-For: 8.8.8.8\r\n\r\n", cipherA)
+	fmt.Fprintf(conn, "POST / HTTP/1.1\r\nHost: b\r\nX-Cipher-Origin: %s\r\nTransfer-Encoding: chunked\r\n\r\n5\r\nhello\r\n6\r\n world\r\n0\r\n\r\n", cipherB)
+	fmt.Fprintf(conn, "GET / HTTP/1.1\r\nHost: a\r\nX-Cipher-Origin: %s\r\n\r\n", cipherA)
+
+	rdr := bufio.NewReader(conn)
+	for _, expected := range []string{
+		"A|127.0.0.1, 8.8.8.8|",
+		"B|127.0.0.1|hello world",
+		"A|127.0.0.1|",
+	} {
+		resp, err := http.ReadResponse(rdr, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, err := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(body) != expected {
+			t.Fatalf("http reply not match: %q, expected %q", body, expected)
+		}
+	}
+}
+
+func TestHTTPPerRequestNoCipher(t *testing.T) {
+	frontd, stop := startListener(t, &listener{httpPerRequest: true})
+	defer stop()
+
+	a, cipherA := newTestBackend("A")
+	defer a.Close()
+
+	conn, err := net.Dial("tcp", frontd)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(time.Second * 5))
+
+	fmt.Fprintf(conn, "GET / HTTP/1.1\r\nHost: a\r\nX-Cipher-Origin: %s\r\n\r\n", cipherA)
+	fmt.Fprintf(conn, "GET / HTTP/1.1\r\nHost: a\r\n\r\n")
+
+	rdr := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(rdr, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+
+	b, err := ioutil.ReadAll(rdr)
+	if !strings.Contains(string(b), "4108") {
+		t.Fatalf("expected 4108, got %q (%v)", b, err)
+	}
+}
+
+func TestHTTPPerRequestHeaderSize(t *testing.T) {
+	frontd, stop := startListener(t, &listener{httpPerRequest: true})
+	defer stop()
+
+	a, cipherA := newTestBackend("A")
+	defer a.Close()
+
+	conn := dialListener(t, frontd)
+	defer conn.Close()
+
+	// a header within the limit, then one above it
+	fmt.Fprintf(conn, "GET / HTTP/1.1\r\nHost: a\r\nX-Cipher-Origin: %s\r\n\r\n", cipherA)
+	fmt.Fprintf(conn, "GET / HTTP/1.1\r\nHost: a\r\nX-Cipher-Origin: %s\r\n", cipherA)
+	go func() {
+		for i := 0; i*100 < _maxHTTPHeaderSize*2; i++ {
+			if _, err := fmt.Fprintf(conn, "X-Padding-%d: %s\r\n", i, strings.Repeat("x", 80)); err != nil {
+				return
+			}
+		}
+		fmt.Fprintf(conn, "\r\n")
+	}()
+
+	rdr := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(rdr, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("unexpected status %d", resp.StatusCode)
+	}
+
+	resp, err = http.ReadResponse(rdr, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if string(body) != "4108" {
+		t.Fatalf("expected 4108, got %d %q", resp.StatusCode, body)
+	}
+}
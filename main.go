@@ -3,11 +3,13 @@ package main
 import (
 	"bufio"
 	"bytes"
+	"crypto/tls"
 	"encoding/base64"
 	"errors"
 	"fmt"
 	"io"
 	"log"
+	"math"
 	"net"
 	"net/http"
 	"os"
@@ -15,14 +17,13 @@ import (
 	"runtime/debug"
 	"strconv"
 	"strings"
-	"sync"
-	"sync/atomic"
 	"syscall"
 	"time"
 
 	_ "net/http/pprof"
 
 	"github.com/xindong/frontd/aes256cbc"
+	"golang.org/x/net/http2"
 )
 
 const (
@@ -32,36 +33,59 @@ const (
 )
 
 var (
-	_hdrCipherOrigin   = []byte("x-cipher-origin")
-	_hdrForwardedFor   = []byte("x-forwarded-for")
-	_maxHTTPHeaderSize = 4096 * 2
-	_minHTTPHeaderSize = 32
+	_hdrCipherOrigin      = []byte("x-cipher-origin")
+	_hdrForwardedFor      = []byte("x-forwarded-for")
+	_hdrUpgrade           = []byte("upgrade:")
+	_hdrWebSocketProtocol = []byte("sec-websocket-protocol:")
+	_hdrWebSocketKey      = []byte("sec-websocket-key:")
+	_maxHTTPHeaderSize    = 4096 * 2
+	_minHTTPHeaderSize    = 32
 )
 
+// HTTP status replied in HTTP/WebSocket mode for each error code
+var _httpStatusByErrCode = map[string]int{
+	"4100": http.StatusForbidden,
+	"4101": http.StatusGatewayTimeout,
+	"4102": http.StatusBadGateway,
+	"4104": http.StatusBadRequest,
+	"4106": http.StatusForbidden,
+	"4107": http.StatusBadRequest,
+	"4108": http.StatusBadRequest,
+	"4110": http.StatusTooManyRequests,
+	"4111": http.StatusServiceUnavailable,
+	"4112": http.StatusServiceUnavailable,
+	"4113": http.StatusForbidden,
+	"4114": http.StatusForbidden,
+}
+
 var (
 	_SecretPassphase []byte
 	_Aes256CBC       = aes256cbc.New()
 )
 
-var (
-	_BackendAddrCacheMutex sync.Mutex
-	_BackendAddrCache      atomic.Value
-)
-
 var (
 	_DefaultPort        = 4043
 	_BackendDialTimeout = 5
 	_ConnReadTimeout    = time.Second * 30
+	_HalfCloseTimeout   = time.Second * 60
+	_HTTPPerRequest     = false
+	_WSBridgePath       = ""
+	_ProxyProtocol      = false
+	_ProxyTrusted       []*net.IPNet
+	_SNIDomain          = ""
 )
 
-type backendAddrMap map[string][]byte
-
 func main() {
+	setup()
+	listen()
+	log.Println("Exiting")
+}
+
+// setup configures frontd from the environment
+func setup() {
 	runtime.GOMAXPROCS(runtime.NumCPU())
 	os.Setenv("GOTRACEBACK", "crash")
 
-	_BackendAddrCache.Store(make(backendAddrMap))
-
 	var lim syscall.Rlimit
 	syscall.Getrlimit(syscall.RLIMIT_NOFILE, &lim)
 	if lim.Cur < _MaxOpenfile || lim.Max < _MaxOpenfile {
@@ -82,37 +106,393 @@ func main() {
 		_BackendDialTimeout = bt
 	}
 
+	cacheSize, err := strconv.Atoi(os.Getenv("ADDR_CACHE_SIZE"))
+	if err != nil || cacheSize <= 0 {
+		cacheSize = _MaxBackendAddrCacheCount
+	}
+	cacheTTL, err := strconv.Atoi(os.Getenv("ADDR_CACHE_TTL"))
+	if err != nil || cacheTTL < 0 {
+		cacheTTL = 3600
+	}
+	_addrCache.configure(cacheSize, time.Second*time.Duration(cacheTTL))
+
 	connReadTimeout, err := strconv.Atoi(os.Getenv("CONN_READ_TIMEOUT"))
 	if err == nil && connReadTimeout >= 0 {
 		_ConnReadTimeout = time.Second * time.Duration(connReadTimeout)
 	}
+	halfCloseTimeout, err := strconv.Atoi(os.Getenv("HALF_CLOSE_TIMEOUT"))
+	if err == nil && halfCloseTimeout > 0 {
+		_HalfCloseTimeout = time.Second * time.Duration(halfCloseTimeout)
+	}
+
+	perRequest, err := strconv.ParseBool(os.Getenv("HTTP_PER_REQUEST"))
+	if err == nil {
+		_HTTPPerRequest = perRequest
+	}
+
+	_WSBridgePath = os.Getenv("WS_BRIDGE_PATH")
+
+	proxyProtocol, err := strconv.ParseBool(os.Getenv("PROXY_PROTOCOL"))
+	if err == nil {
+		_ProxyProtocol = proxyProtocol
+	}
+	_ProxyTrusted, err = parseCIDRs(os.Getenv("PROXY_TRUSTED"))
+	if err != nil {
+		log.Fatal("invalid PROXY_TRUSTED: ", err)
+	}
 
 	listenPort, err := strconv.Atoi(os.Getenv("LISTEN_PORT"))
 	if err == nil && listenPort > 0 && listenPort <= 65535 {
 		_DefaultPort = listenPort
 	}
 
+	_h2Server.IdleTimeout = _ConnReadTimeout
+
+	if certFile := os.Getenv("TLS_CERT"); len(certFile) > 0 {
+		_TLSConfig, err = loadTLSConfig(certFile, os.Getenv("TLS_KEY"))
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	_ConnRatePerIP, _ConnBurstPerIP = rateFromEnv("CONN_RATE_PER_IP", "CONN_BURST_PER_IP")
+	_ConnRatePerSubnet, _ConnBurstPerSubnet = rateFromEnv("CONN_RATE_PER_SUBNET", "CONN_BURST_PER_SUBNET")
+
+	maxConnPerIP, err := strconv.Atoi(os.Getenv("MAX_CONN_PER_IP"))
+	if err == nil && maxConnPerIP > 0 {
+		_MaxConnPerIP = maxConnPerIP
+	}
+
+	queueSize, err := strconv.Atoi(os.Getenv("ADMISSION_QUEUE"))
+	if err != nil || queueSize < 0 {
+		queueSize = 0
+	}
+	queueTimeout, err := strconv.Atoi(os.Getenv("ADMISSION_TIMEOUT_MS"))
+	if err != nil || queueTimeout < 0 {
+		queueTimeout = 0
+	}
+	maxHandshakes, err := strconv.Atoi(os.Getenv("MAX_HANDSHAKES"))
+	if err == nil && maxHandshakes > 0 {
+		_handshakeGate.configure(maxHandshakes, queueSize, time.Millisecond*time.Duration(queueTimeout))
+	}
+	maxDials, err := strconv.Atoi(os.Getenv("MAX_DIALS"))
+	if err == nil && maxDials > 0 {
+		_dialGate.configure(maxDials, queueSize, time.Millisecond*time.Duration(queueTimeout))
+	}
+	decryptWorkers, err := strconv.Atoi(os.Getenv("DECRYPT_WORKERS"))
+	if err == nil && decryptWorkers > 0 {
+		_decryptGate.configure(decryptWorkers, queueSize, time.Millisecond*time.Duration(queueTimeout))
+	}
+
+	badTokenCacheSize, err := strconv.Atoi(os.Getenv("BAD_TOKEN_CACHE_SIZE"))
+	if err == nil && badTokenCacheSize > 0 {
+		_BadTokenCacheSize = badTokenCacheSize
+	}
+	badTokenTTL, err := strconv.Atoi(os.Getenv("BAD_TOKEN_TTL"))
+	if err == nil && badTokenTTL > 0 {
+		_BadTokenTTL = time.Second * time.Duration(badTokenTTL)
+	}
+	_badTokens.configure(_BadTokenCacheSize, _BadTokenTTL)
+
+	banFailures, err := strconv.Atoi(os.Getenv("BAN_FAILURES"))
+	if err == nil && banFailures > 0 {
+		_BanFailures = banFailures
+	}
+	banWindow, err := strconv.Atoi(os.Getenv("BAN_WINDOW"))
+	if err == nil && banWindow > 0 {
+		_BanWindow = time.Second * time.Duration(banWindow)
+	}
+	banDuration, err := strconv.Atoi(os.Getenv("BAN_DURATION"))
+	if err == nil && banDuration > 0 {
+		_BanDuration = time.Second * time.Duration(banDuration)
+	}
+	_bans = newBanTable(_BanFailures, _BanWindow, _BanDuration)
+	if _bans.enabled() {
+		go sweepBans(_bans)
+	}
+
+	nonceTTL, err := strconv.Atoi(os.Getenv("NONCE_TTL"))
+	if err == nil && nonceTTL > 0 {
+		_NonceTTL = time.Second * time.Duration(nonceTTL)
+	}
+	_NonceRedis = os.Getenv("NONCE_REDIS")
+	if len(_NonceRedis) > 0 {
+		_nonces = newRedisNonceStore(_NonceRedis)
+	}
+
+	_defaultBackendLimit, err = parseBackendLimit(os.Getenv("BACKEND_MAX_CONNS") + "/" + os.Getenv("BACKEND_DIAL_RATE"))
+	if err != nil {
+		log.Fatal(err)
+	}
+	_backendLimits, err = parseBackendLimits(os.Getenv("BACKEND_LIMITS"))
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	breakerFailures, err := strconv.Atoi(os.Getenv("BREAKER_FAILURES"))
+	if err == nil && breakerFailures > 0 {
+		_BreakerFailures = breakerFailures
+	}
+	breakerCooldown, err := strconv.Atoi(os.Getenv("BREAKER_COOLDOWN"))
+	if err == nil && breakerCooldown > 0 {
+		_BreakerCooldown = time.Second * time.Duration(breakerCooldown)
+	}
+	breakerProbes, err := strconv.Atoi(os.Getenv("BREAKER_PROBES"))
+	if err == nil && breakerProbes > 0 {
+		_BreakerProbes = breakerProbes
+	}
+	_backends = newBackendTable(_defaultBackendLimit, _backendLimits,
+		breakerConfig{_BreakerFailures, _BreakerCooldown, _BreakerProbes})
+	go sweepBackends(_backends)
+
+	_ConsulAddr = os.Getenv("CONSUL_ADDR")
+	_ConsulToken = os.Getenv("CONSUL_TOKEN")
+
+	if dnsServer := os.Getenv("DNS_SERVER"); len(dnsServer) > 0 {
+		if _, _, err := net.SplitHostPort(dnsServer); err != nil {
+			dnsServer = net.JoinHostPort(dnsServer, "53")
+		}
+		_DNSServer = dnsServer
+	}
+	dnsStale, err := strconv.Atoi(os.Getenv("DNS_STALE"))
+	if err == nil && dnsStale >= 0 {
+		_DNSStale = time.Second * time.Duration(dnsStale)
+	}
+
+	reloadEvery, err := strconv.Atoi(os.Getenv("RELOAD_INTERVAL"))
+	if err == nil && reloadEvery > 0 {
+		_reloadEvery = time.Second * time.Duration(reloadEvery)
+	}
+	_RouteTable = os.Getenv("ROUTE_TABLE")
+	if len(_RouteTable) > 0 {
+		if _, err := loadAndWatch(_RouteTable, loadRouteTable); err != nil {
+			log.Fatal(err)
+		}
+	}
+	_RewriteMap = os.Getenv("REWRITE_MAP")
+	if len(_RewriteMap) > 0 {
+		if _, err := loadAndWatch(_RewriteMap, loadRewriteMap); err != nil {
+			log.Fatal(err)
+		}
+	}
+	_CanaryConfig = os.Getenv("CANARY_CONFIG")
+	if len(_CanaryConfig) > 0 {
+		if _, err := loadAndWatch(_CanaryConfig, loadCanaryConfig); err != nil {
+			log.Fatal(err)
+		}
+	}
+	splice, err := strconv.ParseBool(os.Getenv("SPLICE"))
+	if err == nil {
+		_Splice = splice
+	}
+	_relayConfig = &relayConfig{splice: _Splice, halfCloseTimeout: _HalfCloseTimeout}
+	relayWorkers, err := strconv.Atoi(os.Getenv("RELAY_WORKERS"))
+	if err == nil && relayWorkers > 0 {
+		_relayConfig.engine, err = newRelayEngine(relayWorkers, _relaySweepEvery)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	_RevocationList = os.Getenv("REVOCATION_LIST")
+	if len(_RevocationList) > 0 {
+		if _, err := loadAndWatch(_RevocationList, loadRevocationList); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	healthCheckInterval, err := strconv.Atoi(os.Getenv("HEALTH_CHECK_INTERVAL"))
+	if err == nil && healthCheckInterval > 0 {
+		_HealthCheckInterval = time.Second * time.Duration(healthCheckInterval)
+	}
+	healthCheckTimeout, err := strconv.Atoi(os.Getenv("HEALTH_CHECK_TIMEOUT"))
+	if err == nil && healthCheckTimeout > 0 {
+		_HealthCheckTimeout = time.Second * time.Duration(healthCheckTimeout)
+	}
+	healthCheckFall, err := strconv.Atoi(os.Getenv("HEALTH_CHECK_FALL"))
+	if err == nil && healthCheckFall > 0 {
+		_HealthCheckFall = healthCheckFall
+	}
+	healthCheckRise, err := strconv.Atoi(os.Getenv("HEALTH_CHECK_RISE"))
+	if err == nil && healthCheckRise > 0 {
+		_HealthCheckRise = healthCheckRise
+	}
+	// Go escapes such as \r\n are allowed
+	if send := os.Getenv("HEALTH_CHECK_SEND"); len(send) > 0 {
+		send, err := strconv.Unquote(`"` + send + `"`)
+		if err != nil {
+			log.Fatal("invalid HEALTH_CHECK_SEND: ", err)
+		}
+		_HealthCheckSend = []byte(send)
+	}
+	if expect := os.Getenv("HEALTH_CHECK_EXPECT"); len(expect) > 0 {
+		expect, err := strconv.Unquote(`"` + expect + `"`)
+		if err != nil {
+			log.Fatal("invalid HEALTH_CHECK_EXPECT: ", err)
+		}
+		_HealthCheckExpect = []byte(expect)
+	}
+	if _HealthCheckInterval > 0 {
+		go runHealthChecks()
+	}
+
+	_clientLimiter = newClientLimiter(clientLimits{
+		ratePerIP:      _ConnRatePerIP,
+		burstPerIP:     _ConnBurstPerIP,
+		ratePerSubnet:  _ConnRatePerSubnet,
+		burstPerSubnet: _ConnBurstPerSubnet,
+		maxConnPerIP:   _MaxConnPerIP,
+	})
+	if _clientLimiter.enabled() {
+		go sweepClientLimiter(_clientLimiter)
+	}
+
+	_SNIDomain = strings.ToLower(strings.Trim(os.Getenv("SNI_DOMAIN"), "."))
+
 	pprofPort, err := strconv.Atoi(os.Getenv("PPROF_PORT"))
 	if err == nil && pprofPort > 0 && pprofPort <= 65535 {
 		go func() {
 			log.Println(http.ListenAndServe(":"+strconv.Itoa(pprofPort), nil))
 		}()
 	}
+}
 
-	listenAndServe()
+// listen serves the listening ports, the default one in the foreground
+func listen() {
+	for _, m := range strings.Split(os.Getenv("LISTEN_MODES"), ",") {
+		if len(m) == 0 {
+			continue
+		}
+		port, proto, err := parseListenMode(m)
+		if err != nil {
+			log.Fatal(err)
+		}
+		go listenAndServe(port, newListener(proto))
+	}
 
-	log.Println("Exiting")
+	listenAndServe(_DefaultPort, newListener(protoUnknown))
+}
+
+// newListener returns a listener set up from the environment
+func newListener(proto protocol) *listener {
+	return &listener{
+		proto:          proto,
+		proxyProtocol:  _ProxyProtocol,
+		proxyTrusted:   _ProxyTrusted,
+		bans:           _bans,
+		clients:        _clientLimiter,
+		relay:          _relayConfig,
+		tlsConfig:      _TLSConfig,
+		sniDomain:      _SNIDomain,
+		httpPerRequest: _HTTPPerRequest,
+		wsBridgePath:   _WSBridgePath,
+		backends:       _backends,
+	}
+}
+
+// rateFromEnv reads a rate per second and its burst, which defaults to the rate
+func rateFromEnv(rateKey, burstKey string) (rate, burst float64) {
+	rate, err := strconv.ParseFloat(os.Getenv(rateKey), 64)
+	if err != nil || rate <= 0 {
+		return 0, 0
+	}
+	burst, err = strconv.ParseFloat(os.Getenv(burstKey), 64)
+	if err != nil || burst < 1 {
+		burst = math.Max(rate, 1)
+	}
+	return rate, burst
+}
+
+// listener is what a listening port serves its connections with. main sets
+// it up from the environment, tests start their own.
+type listener struct {
+	// unless protoUnknown, the only protocol spoken
+	proto protocol
+	// connections start with a PROXY protocol header, and only come from
+	// proxyTrusted unless it is empty
+	proxyProtocol bool
+	proxyTrusted  []*net.IPNet
+	// decrypt failures of the clients, nil bans nobody
+	bans *banTable
+	// connection limits of the clients, nil limits nobody
+	clients *clientLimiter
+	// TLS is terminated with tlsConfig and passed through for the server
+	// names under sniDomain, neither is served if both are unset
+	tlsConfig *tls.Config
+	sniDomain string
+	// HTTP requests are proxied one by one instead of tunneled
+	httpPerRequest bool
+	// WebSocket handshakes for this path are bridged to TCP backends
+	wsBridgePath string
+	// limits and circuit breakers of the backends, _backends if nil
+	backends *backendTable
+	// how tunnels are relayed, _relayConfig if nil
+	relay *relayConfig
+}
+
+// servesTLS tells if TLS connections are terminated or passed through
+func (l *listener) servesTLS() bool {
+	return l.tlsConfig != nil || len(l.sniDomain) > 0
+}
+
+// trustedProxy tells if a connection from addr may send a PROXY protocol
+// header
+func (l *listener) trustedProxy(addr net.Addr) bool {
+	if len(l.proxyTrusted) == 0 {
+		return true
+	}
+	ip := clientIP(addr)
+	for _, n := range l.proxyTrusted {
+		if ip != nil && n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// parseCIDRs parses a comma separated list of CIDRs or single IPs
+func parseCIDRs(s string) ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+	for _, v := range strings.Split(s, ",") {
+		v = strings.TrimSpace(v)
+		if len(v) == 0 {
+			continue
+		}
+		if !strings.Contains(v, "/") {
+			ip := net.ParseIP(v)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid IP %q", v)
+			}
+			bits := 128
+			if ip4 := ip.To4(); ip4 != nil {
+				ip, bits = ip4, 32
+			}
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, n, err := net.ParseCIDR(v)
+		if err != nil {
+			return nil, err
+		}
+		nets = append(nets, n)
+	}
+	return nets, nil
 }
 
-func listenAndServe() {
-	l, err := net.Listen("tcp", ":"+strconv.Itoa(_DefaultPort))
+func listenAndServe(port int, l *listener) {
+	ln, err := net.Listen("tcp", ":"+strconv.Itoa(port))
 	if err != nil {
 		log.Fatal(err)
 	}
-	defer l.Close()
+	defer ln.Close()
+	log.Fatal(l.serve(ln))
+}
+
+// serve accepts connections from ln until it is closed
+func (l *listener) serve(ln net.Listener) error {
 	var tempDelay time.Duration
 	for {
-		conn, err := l.Accept()
+		conn, err := ln.Accept()
 		if err != nil {
 			if ne, ok := err.(net.Error); ok && ne.Temporary() {
 				if tempDelay == 0 {
@@ -126,16 +506,31 @@ func listenAndServe() {
 				time.Sleep(tempDelay)
 				continue
 			}
-			log.Fatal(err)
+			return err
 		}
 		tempDelay = 0
-		go handleConn(conn)
+		go l.handleConn(conn)
 	}
 }
 
-func handleConn(c net.Conn) {
+// handleConn serves a client connection. Unless the listening port is
+// dedicated to one protocol, the protocol is sniffed from the first bytes.
+func (l *listener) handleConn(c net.Conn) {
+	proto := l.proto
+	relay := l.relay
+	if relay == nil {
+		relay = _relayConfig
+	}
+	backends := l.backends
+	if backends == nil {
+		backends = _backends
+	}
+	// set once the relay engine owns c
+	var detached bool
 	defer func() {
-		c.Close()
+		if !detached {
+			c.Close()
+		}
 		if r := recover(); r != nil {
 			log.Println("Recovered in", r, ":", string(debug.Stack()))
 		}
@@ -143,60 +538,220 @@ func handleConn(c net.Conn) {
 
 	c.SetReadDeadline(time.Now().Add(_ConnReadTimeout))
 
-	rdr := bufio.NewReader(c)
-
-	addr, err := handleBinaryHdr(rdr, c)
-	if err != nil {
-		if err != io.EOF {
-			log.Println("x", err)
+	// with PROXY protocol the client is only known after its header, which
+	// only the trusted proxies may send. The limits of the client are
+	// released along with the connection.
+	var err error
+	if l.proxyProtocol && !l.trustedProxy(c.RemoteAddr()) {
+		countMetric("proxy_untrusted")
+		writeErrCode(c, []byte("4100"), false)
+		log.Println("x untrusted proxy", c.RemoteAddr())
+		return
+	}
+	if !l.proxyProtocol {
+		if l.bans.isBanned(ipAddrFromRemoteAddr(c.RemoteAddr().String())) {
+			writeErrCode(c, []byte("4100"), false)
+			return
+		}
+		clientDone, err := l.clients.admitClient(c)
+		if err != nil {
+			writeErrCode(c, []byte("4110"), false)
+			log.Println(err, c.RemoteAddr())
+			return
 		}
+		c = &clientConn{c, clientDone}
+	}
+
+	// an idle client holds no handshake slot
+	if err = waitReadable(c, c); err != nil {
+		writeErrCode(c, []byte("4103"), false)
+		return
+	}
+	if err = _handshakeGate.acquire(); err != nil {
+		writeErrCode(c, []byte("4111"), false)
+		log.Println(err, c.RemoteAddr())
 		return
 	}
+	handshakeDone := _handshakeGate.releaser()
+	defer handshakeDone()
 
-	var header *bytes.Buffer
-	if addr == nil {
-		// Read first line
-		line, isPrefix, err := rdr.ReadLine()
-		if err != nil || isPrefix {
-			log.Println(err)
-			writeErrCode(c, []byte("4104"), false)
+	// given back once the handshake is over, unless it is still needed
+	rdr, readerDone := newHandshakeReader(c)
+	defer readerDone()
+
+	if l.proxyProtocol {
+		c, err = handleProxyHdr(rdr, c)
+		if err != nil {
+			writeErrCode(c, []byte("4103"), false)
+			log.Println("x", err, c.RemoteAddr())
 			return
 		}
+	}
 
-		cipherAddr := line
+	if proto == protoUnknown {
+		proto, rdr, err = detectHandshake(rdr, readerDone, c, l.servesTLS())
+		if err != nil {
+			// TODO: how to cause error to test this?
+			writeErrCode(c, []byte("4103"), false)
+			if err != io.EOF {
+				log.Println("x", err)
+			}
+			return
+		}
+	}
 
-		// check if it's HTTP request
-		if bytes.Contains(line, []byte("HTTP")) {
-			header = bytes.NewBuffer(line)
-			header.Write([]byte("\n"))
+	if l.proxyProtocol {
+		if l.bans.isBanned(ipAddrFromRemoteAddr(c.RemoteAddr().String())) {
+			writeErrCode(c, []byte("4100"), proto == protoHTTP)
+			return
+		}
+		clientDone, err := l.clients.admitClient(c)
+		if err != nil {
+			writeErrCode(c, []byte("4110"), proto == protoHTTP)
+			log.Println(err, c.RemoteAddr())
+			return
+		}
+		c = &clientConn{c, clientDone}
+	}
 
-			cipherAddr, err = handleHTTPHdr(rdr, c, header)
+	if proto == protoTLS {
+		// the ClientHello may not fit the handshake reader, a bigger one is
+		// only held until the handshake is over
+		tlsRdr, tlsReaderDone := newTLSReader(rdr, c)
+		readerDone()
+		rdr, readerDone = tlsRdr, tlsReaderDone
+		defer readerDone()
+		if len(l.sniDomain) > 0 {
+			serverName, err := peekServerName(rdr)
 			if err != nil {
 				log.Println(err)
 				return
 			}
+			addr, err := sniCipherAddr(serverName, l.sniDomain)
+			if err != nil {
+				writeErrCode(c, l.bans.decryptFailed(ipAddrFromRemoteAddr(c.RemoteAddr().String()), err), false)
+				return
+			}
+			if addr != nil {
+				// pass the TLS stream through untouched
+				handshakeDone()
+				err = tunneling(string(addr), rdr, readerDone, c, nil, relay, backends)
+				detached = err == errDetached
+				if err != nil && !detached {
+					log.Println(err)
+				}
+				return
+			}
+		}
+		if l.tlsConfig == nil {
+			log.Println("no route for tls connection from", c.RemoteAddr())
+			return
+		}
+
+		tc := tls.Server(&bufferedConn{c, rdr, readerDone}, l.tlsConfig)
+		if err := tc.Handshake(); err != nil {
+			log.Println(err)
+			return
+		}
+		if tc.ConnectionState().NegotiatedProtocol == http2.NextProtoTLS {
+			handshakeDone()
+			serveHTTP2(tc, l.bans, backends)
+			return
+		}
+
+		// the rest is spoken over TLS
+		c = tc
+		rdr, readerDone = newHandshakeReader(tc)
+		defer readerDone()
+		proto, rdr, err = detectHandshake(rdr, readerDone, tc, l.servesTLS())
+		if err != nil || proto == protoTLS {
+			writeErrCode(c, []byte("4103"), false)
+			log.Println("x", err)
+			return
+		}
+	}
+
+	var addr []byte
+	var hdr *httpHdr
+	switch proto {
+	case protoHTTP2:
+		handshakeDone()
+		serveHTTP2(&bufferedConn{c, rdr, readerDone}, l.bans, backends)
+		return
+
+	case protoBinary:
+		addr, err = handleBinaryHdr(rdr, c, l.bans)
+		if err == nil && addr == nil {
+			writeErrCode(c, []byte("4103"), false)
+			err = errors.New("binary protocol marker missing")
+		}
+		if err != nil {
+			if err != io.EOF {
+				log.Println("x", err)
+			}
+			return
+		}
+
+	case protoHTTP:
+		if l.httpPerRequest {
+			handshakeDone()
+			err = serveHTTPProxy(rdr, c, l.bans, relay, backends, l.wsBridgePath)
+			if err != nil {
+				log.Println(err)
+			}
+			return
 		}
 
-		// base64 decode
-		dbuf := make([]byte, base64.StdEncoding.DecodedLen(len(cipherAddr)))
-		n, err := base64.StdEncoding.Decode(dbuf, cipherAddr)
+		line, err := readLine(rdr)
 		if err != nil {
-			writeErrCode(c, []byte("4106"), false)
+			log.Println(err)
+			writeErrCode(c, []byte("4107"), true)
+			return
+		}
+		hdr, err = handleHTTPHdr(rdr, c, append([]byte{}, line...), l.wsBridgePath)
+		if err != nil {
+			log.Println(err)
 			return
 		}
 
-		addr, err = backendAddrDecrypt(dbuf[:n])
+		addr, err = cipherAddrDecrypt(hdr.cipherAddr)
 		if err != nil {
-			writeErrCode(c, []byte("4106"), false)
+			writeErrCode(c, l.bans.decryptFailed(ipAddrFromRemoteAddr(c.RemoteAddr().String()), err), true)
+			return
+		}
+
+	default:
+		// Read first line
+		line, err := readLine(rdr)
+		if err != nil {
+			log.Println(err)
+			writeErrCode(c, []byte("4104"), false)
+			return
+		}
+
+		addr, err = cipherAddrDecrypt(line)
+		if err != nil {
+			writeErrCode(c, l.bans.decryptFailed(ipAddrFromRemoteAddr(c.RemoteAddr().String()), err), false)
 			return
 		}
 	}
 
 	// TODO: check if addr is allowed
 
+	handshakeDone()
+
+	if hdr != nil && hdr.bridge {
+		err = bridgeWebSocket(string(addr), rdr, c, hdr.wsKey, hdr.wsProtocol, relay, backends)
+		if err != nil {
+			log.Println(err)
+		}
+		return
+	}
+
 	// Build tunnel
-	err = tunneling(string(addr), rdr, c, header)
-	if err != nil {
+	err = tunneling(string(addr), rdr, readerDone, c, hdr, relay, backends)
+	detached = err == errDetached
+	if err != nil && !detached {
 		log.Println(err)
 	}
 }
@@ -204,13 +759,18 @@ func handleConn(c net.Conn) {
 func writeErrCode(c net.Conn, errCode []byte, httpws bool) {
 	switch httpws {
 	case true:
-		fmt.Fprintf(c, "HTTP/1.1 %s Error\nConnection: Close", errCode)
+		status, ok := _httpStatusByErrCode[string(errCode)]
+		if !ok {
+			status = http.StatusBadGateway
+		}
+		fmt.Fprintf(c, "HTTP/1.1 %d %s\r\nConnection: close\r\nContent-Type: text/plain\r\nContent-Length: %d\r\n\r\n%s",
+			status, http.StatusText(status), len(errCode), errCode)
 	default:
 		c.Write(errCode)
 	}
 }
 
-func handleBinaryHdr(rdr *bufio.Reader, c net.Conn) (addr []byte, err error) {
+func handleBinaryHdr(rdr *bufio.Reader, c net.Conn, bans *banTable) (addr []byte, err error) {
 	// use binary protocol if first byte is 0x00
 	b, err := rdr.ReadByte()
 	if err != nil {
@@ -236,7 +796,7 @@ func handleBinaryHdr(rdr *bufio.Reader, c net.Conn) (addr []byte, err error) {
 		// decrypt
 		addr, err := backendAddrDecrypt(p)
 		if err != nil {
-			writeErrCode(c, []byte("4106"), false)
+			writeErrCode(c, bans.decryptFailed(ipAddrFromRemoteAddr(c.RemoteAddr().String()), err), false)
 			return nil, err
 		}
 
@@ -247,13 +807,28 @@ func handleBinaryHdr(rdr *bufio.Reader, c net.Conn) (addr []byte, err error) {
 	return nil, nil
 }
 
-func handleHTTPHdr(rdr *bufio.Reader, c net.Conn, header *bytes.Buffer) (addr []byte, err error) {
+// httpHdr is an HTTP request header read by handleHTTPHdr
+type httpHdr struct {
+	// header to forward to the backend
+	header     *bytes.Buffer
+	cipherAddr []byte
+	// wsProtocol is the Sec-WebSocket-Protocol entry that carried the cipher
+	// address, it is echoed back to the client if the backend picks none
+	wsProtocol string
+	wsKey      string
+	// bridge the WebSocket to a TCP backend instead of forwarding it
+	bridge bool
+}
+
+func handleHTTPHdr(rdr *bufio.Reader, c net.Conn, reqLine []byte, wsBridgePath string) (*httpHdr, error) {
 	hdrXff := "X-Forwarded-For: " + ipAddrFromRemoteAddr(c.RemoteAddr().String())
 
-	var cipherAddr []byte
+	header := new(bytes.Buffer)
+	hdr := &httpHdr{}
+	var upgrade, wsProtocols string
 	for {
-		line, isPrefix, err := rdr.ReadLine()
-		if err != nil || isPrefix {
+		line, err := readLine(rdr)
+		if err != nil {
 			log.Println(err)
 			writeErrCode(c, []byte("4107"), true)
 			return nil, err
@@ -261,7 +836,7 @@ func handleHTTPHdr(rdr *bufio.Reader, c net.Conn, header *bytes.Buffer) (addr []
 
 		if bytes.HasPrefix(bytes.ToLower(line), _hdrCipherOrigin) {
 			// copy instead of point
-			cipherAddr = []byte(string(bytes.TrimSpace(line[(len(_hdrCipherOrigin) + 1):])))
+			hdr.cipherAddr = []byte(string(bytes.TrimSpace(line[(len(_hdrCipherOrigin) + 1):])))
 			continue
 		}
 
@@ -270,18 +845,28 @@ func handleHTTPHdr(rdr *bufio.Reader, c net.Conn, header *bytes.Buffer) (addr []
 			continue
 		}
 
+		if bytes.HasPrefix(bytes.ToLower(line), _hdrWebSocketProtocol) {
+			// written after the cipher address is taken out, several lines
+			// are joined as prepareWebSocketRequest does
+			if v := bytes.TrimSpace(line[len(_hdrWebSocketProtocol):]); len(v) > 0 {
+				if len(wsProtocols) > 0 {
+					wsProtocols += ", "
+				}
+				wsProtocols += string(v)
+			}
+			continue
+		}
+
+		if bytes.HasPrefix(bytes.ToLower(line), _hdrUpgrade) {
+			upgrade = string(bytes.TrimSpace(line[len(_hdrUpgrade):]))
+		}
+
+		if bytes.HasPrefix(bytes.ToLower(line), _hdrWebSocketKey) {
+			hdr.wsKey = string(bytes.TrimSpace(line[len(_hdrWebSocketKey):]))
+		}
+
 		if len(bytes.TrimSpace(line)) == 0 {
 			// end of HTTP header
-			if len(cipherAddr) == 0 {
-				writeErrCode(c, []byte("4108"), true)
-				return nil, errors.New("empty http cipher address header")
-			}
-			if len(hdrXff) > 0 {
-				header.Write([]byte(hdrXff))
-				header.Write([]byte("\n"))
-			}
-			header.Write(line)
-			header.Write([]byte("\n"))
 			break
 		}
 
@@ -294,37 +879,129 @@ func handleHTTPHdr(rdr *bufio.Reader, c net.Conn, header *bytes.Buffer) (addr []
 		}
 	}
 
-	return cipherAddr, nil
+	if fields := strings.Fields(string(reqLine)); strings.EqualFold(upgrade, "websocket") && len(fields) == 3 {
+		target := fields[1]
+		// browsers can not set headers on WebSocket handshakes
+		if len(hdr.cipherAddr) == 0 {
+			hdr.cipherAddr, target, wsProtocols, hdr.wsProtocol = websocketCipher(target, wsProtocols)
+			reqLine = []byte(fields[0] + " " + target + " " + fields[2])
+		}
+
+		if isWebSocketBridge(target, wsBridgePath) {
+			hdr.bridge = true
+			if len(hdr.wsProtocol) == 0 && len(wsProtocols) > 0 {
+				hdr.wsProtocol = strings.TrimSpace(strings.Split(wsProtocols, ",")[0])
+			}
+		}
+	}
+
+	if len(hdr.cipherAddr) == 0 {
+		writeErrCode(c, []byte("4108"), true)
+		return nil, errors.New("empty http cipher address header")
+	}
+
+	hdr.header = bytes.NewBuffer(make([]byte, 0, len(reqLine)+header.Len()+len(hdrXff)+64))
+	hdr.header.Write(reqLine)
+	hdr.header.Write([]byte("\n"))
+	header.WriteTo(hdr.header)
+	if len(wsProtocols) > 0 {
+		hdr.header.Write([]byte("Sec-WebSocket-Protocol: " + wsProtocols + "\n"))
+	}
+	hdr.header.Write([]byte(hdrXff))
+	hdr.header.Write([]byte("\n\n"))
+
+	return hdr, nil
 }
 
-// tunneling to backend
-func tunneling(addr string, rdr *bufio.Reader, c net.Conn, header *bytes.Buffer) error {
-	backend, err := dialTimeout("tcp", addr, time.Second*time.Duration(_BackendDialTimeout))
+// tunneling relays between c and the backend of addr. What rdr has read
+// ahead of c is sent first, then readerDone is called as rdr is not needed
+// anymore. It returns errDetached if the relay engine took c over.
+func tunneling(addr string, rdr *bufio.Reader, readerDone func(), c net.Conn, hdr *httpHdr, relay *relayConfig, backends *backendTable) error {
+	backend, errCode, err := backends.dialTarget(addr, ipAddrFromRemoteAddr(c.RemoteAddr().String()))
 	if err != nil {
-		// handle error
-		switch err := err.(type) {
-		case net.Error:
-			if err.Timeout() {
-				writeErrCode(c, []byte("4101"), false)
+		writeErrCode(c, errCode, hdr != nil)
+		return err
+	}
+	return tunnel(backend, rdr, readerDone, c, hdr, relay)
+}
+
+// tunnel is tunneling to a backend dialed already, which it closes
+func tunnel(backend net.Conn, rdr *bufio.Reader, readerDone func(), c net.Conn, hdr *httpHdr, relay *relayConfig) error {
+	var err error
+	detached := false
+	defer func() {
+		if !detached {
+			backend.Close()
+		}
+	}()
+
+	var src io.Reader = backend
+	if hdr != nil {
+		hdr.header.WriteTo(backend)
+		if len(hdr.wsProtocol) > 0 {
+			brdr := bufio.NewReader(backend)
+			err = relayWebSocketHandshake(brdr, c, hdr.wsProtocol)
+			if err != nil {
 				return err
 			}
+			src = brdr
 		}
-		writeErrCode(c, []byte("4102"), false)
+	}
+
+	if err := flushBuffered(backend, rdr); err != nil {
 		return err
 	}
-	defer backend.Close()
+	readerDone()
 
-	if header != nil {
-		header.WriteTo(backend)
+	if relay.engine != nil && src == backend && relay.engine.add(c, backend, relay.halfCloseTimeout) {
+		detached = true
+		return errDetached
 	}
 
 	// Start transfering data
-	go pipe(c, backend, c, backend)
-	pipe(backend, rdr, backend, c)
+	pipeBoth(c, c, backend, src, relay)
 
 	return nil
 }
 
+// dialBackend connects to addr, returning the error code for the client on failure
+func (t *backendTable) dialBackend(addr string) (net.Conn, []byte, error) {
+	if !_health.healthy(addr) {
+		countMetric("health_rejected")
+		return nil, []byte("4102"), errUnhealthy
+	}
+
+	slot, err := t.admit(addr, time.Now())
+	switch err {
+	case nil:
+	case errBreakerOpen:
+		return nil, []byte("4102"), err
+	default:
+		return nil, []byte("4112"), err
+	}
+
+	if err := _dialGate.acquire(); err != nil {
+		slot.done()
+		return nil, []byte("4111"), err
+	}
+	defer _dialGate.release()
+
+	backend, err := dialTimeout("tcp", addr, time.Second*time.Duration(_BackendDialTimeout))
+	slot.dialed(err, time.Now())
+	if err != nil {
+		slot.done()
+		// handle error
+		switch err := err.(type) {
+		case net.Error:
+			if err.Timeout() {
+				return nil, []byte("4101"), err
+			}
+		}
+		return nil, []byte("4102"), err
+	}
+	return &backendConn{backend, slot.done}, nil, nil
+}
+
 func dialTimeout(network, address string, timeout time.Duration) (conn net.Conn, err error) {
 	m := int(timeout / time.Second)
 	for i := 0; i < m; i++ {
@@ -337,45 +1014,62 @@ func dialTimeout(network, address string, timeout time.Duration) (conn net.Conn,
 	return
 }
 
-func backendAddrDecrypt(key []byte) ([]byte, error) {
-	// Try to check cache
-	m1 := _BackendAddrCache.Load().(backendAddrMap)
-	k1 := string(key)
-	addr, ok := m1[k1]
-	if ok {
-		return addr, nil
+// cipherAddrDecrypt decodes a base64 cipher address and decrypts it.
+// The URL-safe alphabet and missing padding are accepted as well, as used
+// in URLs and WebSocket subprotocols.
+func cipherAddrDecrypt(cipherAddr []byte) ([]byte, error) {
+	if bytes.ContainsAny(cipherAddr, "-_") || len(cipherAddr)%4 != 0 {
+		cipherAddr = bytes.Map(func(r rune) rune {
+			switch r {
+			case '-':
+				return '+'
+			case '_':
+				return '/'
+			}
+			return r
+		}, cipherAddr)
+		for len(cipherAddr)%4 != 0 {
+			cipherAddr = append(cipherAddr, '=')
+		}
 	}
 
-	// Try to decrypt it (AES)
-	addr, err := _Aes256CBC.Decrypt(_SecretPassphase, key)
+	dbuf := make([]byte, base64.StdEncoding.DecodedLen(len(cipherAddr)))
+	n, err := base64.StdEncoding.Decode(dbuf, cipherAddr)
 	if err != nil {
 		return nil, err
 	}
-
-	backendAddrList(k1, addr)
-	return addr, nil
+	return backendAddrDecrypt(dbuf[:n])
 }
 
-func backendAddrList(key string, val []byte) {
-	_BackendAddrCacheMutex.Lock()
-	defer _BackendAddrCacheMutex.Unlock()
+func backendAddrDecrypt(key []byte) ([]byte, error) {
+	if revokedToken(key) {
+		return nil, errRevoked
+	}
 
-	m1 := _BackendAddrCache.Load().(backendAddrMap)
-	// double check
-	if _, ok := m1[key]; ok {
-		return
+	// Try to check cache
+	if addr, ok := _addrCache.get(key); ok {
+		return useToken(addr)
 	}
 
-	m2 := make(backendAddrMap)
-	// flush cache if there is way too many
-	if len(m1) < _MaxBackendAddrCacheCount {
-		// copy-on-write
-		for k, v := range m1 {
-			m2[k] = v // copy all data from the current object to the new one
-		}
+	badKey := badTokenKey(key)
+	if _, ok := _badTokens.get(badKey); ok {
+		countMetric("bad_token_hits")
+		return nil, errBadToken
+	}
+
+	if err := _decryptGate.acquire(); err != nil {
+		return nil, err
+	}
+	// Try to decrypt it (AES)
+	addr, err := _Aes256CBC.Decrypt(_SecretPassphase, key)
+	_decryptGate.release()
+	if err != nil {
+		_badTokens.set(string(badKey), nil)
+		return nil, err
 	}
-	m2[key] = val
-	_BackendAddrCache.Store(m2) // atomically replace the current object with the new one
+
+	_addrCache.set(string(key), addr)
+	return useToken(addr)
 }
 
 // Request.RemoteAddress contains port, which we want to remove i.e.:
@@ -388,38 +1082,61 @@ func ipAddrFromRemoteAddr(s string) string {
 	return s[:idx]
 }
 
-// pipe upstream and downstream
-func pipe(dst io.Writer, src io.Reader, dstconn, srcconn net.Conn) {
+// pipeBoth relays between c and backend, csrc and bsrc being what is read
+// from them, and closes both once the two directions are done
+func pipeBoth(c net.Conn, csrc io.Reader, backend net.Conn, bsrc io.Reader, relay *relayConfig) {
+	h := &halfClose{timeout: relay.halfCloseTimeout}
+	done := make(chan struct{})
+	go func() {
+		pipe(c, bsrc, c, backend, h, relay.splice)
+		close(done)
+	}()
+	pipe(backend, csrc, backend, c, h, relay.splice)
+	<-done
+	c.Close()
+	backend.Close()
+}
+
+// pipe relays one direction of a tunnel, spliced if splice and possible. At
+// EOF only the write side of dstconn is shut down, the other direction goes
+// on; an error closes both.
+func pipe(dst io.Writer, src io.Reader, dstconn, srcconn net.Conn, h *halfClose, splice bool) {
 	defer func() {
 		if r := recover(); r != nil {
 			log.Println("Recovered in", r, ":", string(debug.Stack()))
+			dstconn.Close()
+			srcconn.Close()
 		}
 	}()
 
-	// only close dst when done
-	defer dstconn.Close()
+	if splice {
+		if spliced, err := splicePipe(dst, src, dstconn, srcconn, h); spliced {
+			h.end(dstconn, srcconn, err)
+			return
+		}
+	}
+	h.end(dstconn, srcconn, pipeCopy(dst, src, srcconn, h))
+}
 
-	buf := make([]byte, 2*4096)
+// pipeCopy copies src to dst through a pooled buffer, only taken while
+// there is something to read. It returns nil at EOF.
+func pipeCopy(dst io.Writer, src io.Reader, srcconn net.Conn, h *halfClose) error {
+	last := time.Now()
 	for {
-		srcconn.SetReadDeadline(time.Now().Add(_ConnReadTimeout))
-		nr, er := src.Read(buf)
-		if nr > 0 {
-			nw, ew := dst.Write(buf[0:nr])
-			if ew != nil {
-				break
-			}
-			if nr != nw {
-				break
-			}
+		srcconn.SetReadDeadline(h.readDeadline())
+		err := waitReadable(src, srcconn)
+		if err == nil {
+			err = pipeOnce(dst, src)
+			last = time.Now()
 		}
-		if neterr, ok := er.(net.Error); ok && neterr.Timeout() {
+		if neterr, ok := err.(net.Error); ok && neterr.Timeout() && !h.expired(last) {
 			continue
 		}
-		if er == io.EOF {
-			break
+		if err == io.EOF {
+			return nil
 		}
-		if er != nil {
-			break
+		if err != nil {
+			return err
 		}
 	}
 }
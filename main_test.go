@@ -1,6 +1,7 @@
 package main
 
 import (
+	"bufio"
 	"bytes"
 	"encoding/hex"
 	"errors"
@@ -12,8 +13,10 @@ import (
 	"math/rand"
 	"net"
 	"net/http"
+	"net/url"
 	"os"
 	"strconv"
+	"strings"
 	"testing"
 	"time"
 
@@ -55,7 +58,9 @@ func TestMain(m *testing.M) {
 	os.Setenv("MAX_HTTP_HEADER_SIZE", "1024")
 	os.Setenv("PPROF_PORT", "62866")
 
-	go main()
+	// configured before the tests read the settings
+	setup()
+	go listen()
 
 	// start http server
 	http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
@@ -171,12 +176,16 @@ func testHTTPServer(hdrs map[string]string, expected string) {
 }
 
 func testWebSocketServer(hdrs map[string]string, expected string) {
+	testWebSocketURL("ws://"+string(_defaultFrontdAddr)+"/echo", nil, hdrs, expected)
+}
+
+func testWebSocketURL(url string, protocols []string, hdrs map[string]string, expected string) *websocket.Config {
 	origin := "http://127.0.0.1/"
-	url := "ws://" + string(_defaultFrontdAddr) + "/echo"
 	cfg, err := websocket.NewConfig(url, origin)
 	if err != nil {
 		panic(err)
 	}
+	cfg.Protocol = protocols
 
 	for k, v := range hdrs {
 		cfg.Header.Set(k, v)
@@ -186,6 +195,7 @@ func testWebSocketServer(hdrs map[string]string, expected string) {
 	if err != nil {
 		panic(err)
 	}
+	defer ws.Close()
 	if _, err := ws.Write([]byte(expected)); err != nil {
 		panic(err)
 	}
@@ -201,6 +211,96 @@ func testWebSocketServer(hdrs map[string]string, expected string) {
 		panic(fmt.Errorf("websocket reply not match: %s", string(msg[:n])))
 	}
 
+	return ws.Config()
+}
+
+// TestWebSocketCipher ---
+func TestWebSocketCipher(t *testing.T) {
+	cipherAddr, err := encryptText(_websocketServerAddr, _secret)
+	if err != nil {
+		panic(err)
+	}
+	urlSafe := strings.NewReplacer("+", "-", "/", "_", "=", "").Replace(string(cipherAddr))
+
+	for _, perRequest := range []bool{false, true} {
+		addr, stop := startListener(t, &listener{httpPerRequest: perRequest})
+		defer stop()
+		frontd := "ws://" + addr
+
+		testWebSocketURL(frontd+"/echo?a=1&x-cipher-origin="+url.QueryEscape(string(cipherAddr)), nil, nil, "query")
+
+		testWebSocketURL(frontd+"/"+url.PathEscape(string(cipherAddr))+"/echo", nil, nil, "path")
+
+		testWebSocketURL(frontd+"/"+urlSafe+"/echo", nil, nil, "url-safe path")
+
+		protocol := "x-cipher-origin." + urlSafe
+		cfg := testWebSocketURL(frontd+"/echo", []string{protocol}, nil, "protocol")
+		if len(cfg.Protocol) != 1 || cfg.Protocol[0] != protocol {
+			t.Fatalf("websocket protocol not selected: %v", cfg.Protocol)
+		}
+	}
+}
+
+// TestWebSocketProtocolLines ---
+func TestWebSocketProtocolLines(t *testing.T) {
+	cipherAddr, err := encryptText(_websocketServerAddr, _secret)
+	if err != nil {
+		panic(err)
+	}
+	urlSafe := strings.NewReplacer("+", "-", "/", "_", "=", "").Replace(string(cipherAddr))
+
+	handshake := func(lines string) (*http.Response, error) {
+		conn, err := net.Dial("tcp", _defaultFrontdAddr)
+		if err != nil {
+			panic(err)
+		}
+		defer conn.Close()
+		conn.SetDeadline(time.Now().Add(time.Second * 5))
+		fmt.Fprintf(conn, "GET /echo HTTP/1.1\r\nHost: 127.0.0.1\r\nOrigin: http://127.0.0.1/\r\nUpgrade: websocket\r\n"+
+			"Connection: Upgrade\r\nSec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==\r\nSec-WebSocket-Version: 13\r\n%s\r\n", lines)
+		return http.ReadResponse(bufio.NewReader(conn), nil)
+	}
+
+	// the cipher address is found in any of the lines, the others are kept
+	resp, err := handshake("Sec-WebSocket-Protocol: x-cipher-origin." + urlSafe + "\r\nSec-WebSocket-Protocol: chat\r\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusSwitchingProtocols || resp.Header.Get("Sec-WebSocket-Protocol") != "chat" {
+		t.Fatalf("unexpected reply %d %v", resp.StatusCode, resp.Header)
+	}
+
+	// neither a longer header name nor a bare one are the protocols
+	for _, line := range []string{"Sec-WebSocket-Protocol-X: chat", "Sec-WebSocket-Protocol"} {
+		resp, err = handshake("Sec-WebSocket-Protocol: x-cipher-origin." + urlSafe + "\r\n" + line + "\r\n")
+		if err != nil {
+			t.Fatalf("%s: %v", line, err)
+		}
+		if resp.Header.Get("Sec-WebSocket-Protocol") == "chat" {
+			t.Fatalf("%s: taken as protocol", line)
+		}
+	}
+}
+
+// TestWebSocketHandshakeError ---
+func TestWebSocketHandshakeError(t *testing.T) {
+	for path, expected := range map[string]string{
+		"/":          "HTTP/1.1 400 Bad Request",
+		"/echo":      "HTTP/1.1 403 Forbidden",
+		"/MjF3MjE=/": "HTTP/1.1 403 Forbidden",
+	} {
+		conn, err := net.Dial("tcp", _defaultFrontdAddr)
+		if err != nil {
+			panic(err)
+		}
+		fmt.Fprintf(conn, "GET %s HTTP/1.1\r\nHost: 127.0.0.1\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n"+
+			"Sec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==\r\nSec-WebSocket-Version: 13\r\n\r\n", path)
+		b, _ := ioutil.ReadAll(conn)
+		conn.Close()
+		if !bytes.HasPrefix(b, []byte(expected)) {
+			t.Fatalf("%s: expected %q, got %q", path, expected, b)
+		}
+	}
 }
 
 // TestEchoServer ---
@@ -0,0 +1,12 @@
+package main
+
+import (
+	"expvar"
+)
+
+// _metrics are published by expvar at /debug/vars on PPROF_PORT
+var _metrics = expvar.NewMap("frontd")
+
+func countMetric(name string) {
+	_metrics.Add(name, 1)
+}
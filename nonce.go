@@ -0,0 +1,213 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var errReplayed = errors.New("one-time token used already or expired")
+
+var (
+	// how long a nonce is remembered, unless its token expires earlier
+	_NonceTTL = time.Hour * 24
+	// host:port of a Redis server sharing the seen nonces between frontd
+	// instances, they are kept in memory without it
+	_NonceRedis string
+
+	_nonceTimeout   = time.Second * 2
+	_nonceIdleConns = 16
+
+	_nonces nonceStore = newMemoryNonceStore()
+)
+
+// nonceStore remembers the nonces of the one-time tokens used
+type nonceStore interface {
+	// add records a nonce for ttl, it reports false if it was there already
+	add(nonce string, ttl time.Duration) (bool, error)
+}
+
+// useToken checks a decrypted target against the revocation list and strips
+// the options only meant for frontd: nonce and exp of a one-time token, such
+// as "10.0.0.1:9000?nonce=abc&exp=1700000000", and the key ID kid. It returns
+// errReplayed if the nonce has been seen or the token has expired.
+func useToken(addr []byte) ([]byte, error) {
+	i := bytes.IndexByte(addr, '?')
+	if i < 0 || !hasTokenOption(addr[i:]) {
+		if revokedTarget(string(addr), "") {
+			return nil, errRevoked
+		}
+		return addr, nil
+	}
+
+	var nonce, kid string
+	var exp int64
+	// the other options are kept in order, the target may be looked up as is
+	target := append([]byte{}, addr[:i]...)
+	sep := byte('?')
+	for _, opt := range strings.Split(string(addr[i+1:]), "&") {
+		switch {
+		case strings.HasPrefix(opt, "nonce="):
+			nonce = opt[len("nonce="):]
+		case strings.HasPrefix(opt, "kid="):
+			kid = opt[len("kid="):]
+		case strings.HasPrefix(opt, "exp="):
+			n, err := strconv.ParseInt(opt[len("exp="):], 10, 64)
+			if err != nil {
+				return nil, fmt.Errorf("invalid token expiry %q", opt)
+			}
+			exp = n
+		default:
+			target = append(append(target, sep), opt...)
+			sep = '&'
+		}
+	}
+	if revokedTarget(string(target), kid) {
+		return nil, errRevoked
+	}
+
+	ttl := _NonceTTL
+	if exp > 0 {
+		ttl = time.Until(time.Unix(exp, 0))
+		if ttl <= 0 {
+			countMetric("nonce_expired")
+			return nil, errReplayed
+		}
+	}
+	if len(nonce) == 0 {
+		return target, nil
+	}
+	if ttl < time.Second {
+		ttl = time.Second
+	}
+
+	ok, err := _nonces.add(nonce, ttl)
+	if err != nil {
+		// fail closed, the token may be used elsewhere
+		countMetric("nonce_errors")
+		log.Println("nonce store:", err)
+		return nil, errServerBusy
+	}
+	if !ok {
+		countMetric("nonce_replayed")
+		return nil, errReplayed
+	}
+	return target, nil
+}
+
+func hasTokenOption(query []byte) bool {
+	for _, opt := range []string{"nonce=", "exp=", "kid="} {
+		if bytes.Contains(query, []byte(opt)) {
+			return true
+		}
+	}
+	return false
+}
+
+// memoryNonceStore keeps the nonces of this instance
+type memoryNonceStore struct {
+	mu    sync.Mutex
+	m     map[string]time.Time
+	sweep time.Time
+}
+
+func newMemoryNonceStore() *memoryNonceStore {
+	return &memoryNonceStore{m: make(map[string]time.Time)}
+}
+
+func (s *memoryNonceStore) add(nonce string, ttl time.Duration) (bool, error) {
+	now := time.Now()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if now.After(s.sweep) {
+		for n, expires := range s.m {
+			if now.After(expires) {
+				delete(s.m, n)
+			}
+		}
+		s.sweep = now.Add(_limiterSweepEvery)
+	}
+	if expires, ok := s.m[nonce]; ok && now.Before(expires) {
+		return false, nil
+	}
+	s.m[nonce] = now.Add(ttl)
+	return true, nil
+}
+
+// redisNonceStore keeps the nonces in Redis with SET NX EX, spoken in RESP
+// over a few reused connections
+type redisNonceStore struct {
+	addr string
+	idle chan *redisConn
+}
+
+type redisConn struct {
+	net.Conn
+	rdr *bufio.Reader
+}
+
+func newRedisNonceStore(addr string) *redisNonceStore {
+	return &redisNonceStore{addr: addr, idle: make(chan *redisConn, _nonceIdleConns)}
+}
+
+func (s *redisNonceStore) add(nonce string, ttl time.Duration) (bool, error) {
+	var c *redisConn
+	select {
+	case c = <-s.idle:
+	default:
+		conn, err := net.DialTimeout("tcp", s.addr, _nonceTimeout)
+		if err != nil {
+			return false, err
+		}
+		c = &redisConn{conn, bufio.NewReader(conn)}
+	}
+
+	ok, err := c.setNX("frontd:nonce:"+nonce, strconv.Itoa(int(ttl/time.Second)))
+	if err != nil {
+		c.Close()
+		return false, err
+	}
+	select {
+	case s.idle <- c:
+	default:
+		c.Close()
+	}
+	return ok, nil
+}
+
+// setNX sets key unless it exists, it reports whether it was set
+func (c *redisConn) setNX(key, seconds string) (bool, error) {
+	c.SetDeadline(time.Now().Add(_nonceTimeout))
+	args := []string{"SET", key, "1", "NX", "EX", seconds}
+	var cmd bytes.Buffer
+	fmt.Fprintf(&cmd, "*%d\r\n", len(args))
+	for _, arg := range args {
+		fmt.Fprintf(&cmd, "$%d\r\n%s\r\n", len(arg), arg)
+	}
+	if _, err := c.Write(cmd.Bytes()); err != nil {
+		return false, err
+	}
+
+	line, err := c.rdr.ReadString('\n')
+	if err != nil {
+		return false, err
+	}
+	line = strings.TrimRight(line, "\r\n")
+	switch {
+	case line == "+OK":
+		return true, nil
+	case line == "$-1" || line == "_":
+		// nil reply, the key exists
+		return false, nil
+	case strings.HasPrefix(line, "-"):
+		return false, errors.New(line[1:])
+	}
+	return false, fmt.Errorf("unexpected redis reply %q", line)
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeRedis answers SET key val NX EX seconds, the only command frontd sends
+type fakeRedis struct {
+	l net.Listener
+
+	mu   sync.Mutex
+	keys map[string]time.Time
+	ttls map[string]int
+}
+
+func newFakeRedis() *fakeRedis {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		panic(err)
+	}
+	r := &fakeRedis{l: l, keys: make(map[string]time.Time), ttls: make(map[string]int)}
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go r.serve(c)
+		}
+	}()
+	return r
+}
+
+func (r *fakeRedis) serve(c net.Conn) {
+	defer c.Close()
+	rdr := bufio.NewReader(c)
+	for {
+		var n int
+		if _, err := fmt.Fscanf(rdr, "*%d\r\n", &n); err != nil {
+			return
+		}
+		args := make([]string, n)
+		for i := range args {
+			var l int
+			if _, err := fmt.Fscanf(rdr, "$%d\r\n", &l); err != nil {
+				return
+			}
+			b := make([]byte, l+2)
+			if _, err := io.ReadFull(rdr, b); err != nil {
+				return
+			}
+			args[i] = string(b[:l])
+		}
+		if len(args) != 6 || args[0] != "SET" || args[3] != "NX" || args[4] != "EX" {
+			fmt.Fprintf(c, "-ERR unexpected command %q\r\n", args)
+			continue
+		}
+		ttl, _ := strconv.Atoi(args[5])
+
+		r.mu.Lock()
+		if expires, ok := r.keys[args[1]]; ok && time.Now().Before(expires) {
+			c.Write([]byte("$-1\r\n"))
+		} else {
+			r.keys[args[1]] = time.Now().Add(time.Second * time.Duration(ttl))
+			r.ttls[args[1]] = ttl
+			c.Write([]byte("+OK\r\n"))
+		}
+		r.mu.Unlock()
+	}
+}
+
+func testOneTimeToken(t *testing.T, target string) {
+	b, err := encryptText([]byte(target), _secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := net.Dial("tcp", _defaultFrontdAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Write(append(b, '\n'))
+	testEchoRound(conn)
+	conn.Close()
+
+	replayed := metricValue("nonce_replayed")
+	testProtocol(append(b, '\n'), []byte("4113"))
+	if metricValue("nonce_replayed") != replayed+1 {
+		t.Fatal("replay not counted")
+	}
+}
+
+func TestOneTimeToken(t *testing.T) {
+	nonce := strconv.FormatInt(time.Now().UnixNano(), 36)
+	testOneTimeToken(t, string(_echoServerAddr)+"?nonce="+nonce)
+
+	// options other than nonce and exp are kept
+	addr, err := useToken([]byte("127.0.0.1:1,127.0.0.1:2?lb=first&nonce=" + nonce + "x&exp=" +
+		strconv.FormatInt(time.Now().Add(time.Minute).Unix(), 10)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(addr) != "127.0.0.1:1,127.0.0.1:2?lb=first" {
+		t.Fatalf("unexpected target %s", addr)
+	}
+
+	b, err := encryptText([]byte(string(_echoServerAddr)+"?nonce="+nonce+"y&exp="+
+		strconv.FormatInt(time.Now().Add(-time.Second).Unix(), 10)), _secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testProtocol(append(b, '\n'), []byte("4113"))
+}
+
+func TestRedisNonceStore(t *testing.T) {
+	r := newFakeRedis()
+	defer func() {
+		r.l.Close()
+		_nonces = newMemoryNonceStore()
+	}()
+	_nonces = newRedisNonceStore(r.l.Addr().String())
+
+	nonce := strconv.FormatInt(time.Now().UnixNano(), 36)
+	testOneTimeToken(t, string(_echoServerAddr)+"?nonce="+nonce)
+	r.mu.Lock()
+	ttl := r.ttls["frontd:nonce:"+nonce]
+	r.mu.Unlock()
+	if ttl != int(_NonceTTL/time.Second) {
+		t.Fatalf("nonce kept for %d seconds", ttl)
+	}
+
+	// no store, no one-time token
+	_nonces = newRedisNonceStore("127.0.0.1:62867")
+	b, err := encryptText([]byte(string(_echoServerAddr)+"?nonce="+nonce+"z"), _secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testProtocol(append(b, '\n'), []byte("4111"))
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"sync"
+)
+
+var errLineTooLong = errors.New("line too long")
+
+const (
+	// the handshake reader fits a cipher address line or an HTTP header
+	// line, longer lines are put together up to _maxLineSize. Protocol
+	// detection grows it for a longer request line.
+	_handshakeReaderSize = 1024
+	_maxLineSize         = 4096
+	// a whole TLS record, for the ClientHello to be peeked at
+	_tlsReaderSize = 5 + 16<<10
+
+	_pipeBufSize = 2 * 4096
+)
+
+var (
+	_handshakeReaders = sync.Pool{New: func() interface{} {
+		return bufio.NewReaderSize(nil, _handshakeReaderSize)
+	}}
+	_tlsReaders = sync.Pool{New: func() interface{} {
+		return bufio.NewReaderSize(nil, _tlsReaderSize)
+	}}
+	_pipeBufs = sync.Pool{New: func() interface{} {
+		buf := make([]byte, _pipeBufSize)
+		return &buf
+	}}
+)
+
+// newHandshakeReader returns a pooled reader of c. The returned function
+// gives it back once, however often called, after which the reader must not
+// be used anymore.
+func newHandshakeReader(c net.Conn) (*bufio.Reader, func()) {
+	rdr := _handshakeReaders.Get().(*bufio.Reader)
+	rdr.Reset(c)
+	var once sync.Once
+	return rdr, func() {
+		once.Do(func() {
+			rdr.Reset(nil)
+			_handshakeReaders.Put(rdr)
+		})
+	}
+}
+
+// newTLSReader returns a pooled reader of c big enough to peek at a
+// ClientHello, starting with what rdr has buffered. rdr can be given back
+// afterwards. The returned function gives the new reader back once, see
+// bufferedConn for a TLS connection to drain it.
+func newTLSReader(rdr *bufio.Reader, c net.Conn) (*bufio.Reader, func()) {
+	tlsRdr := _tlsReaders.Get().(*bufio.Reader)
+	refill(tlsRdr, rdr, c)
+	var once sync.Once
+	return tlsRdr, func() {
+		once.Do(func() {
+			tlsRdr.Reset(nil)
+			_tlsReaders.Put(tlsRdr)
+		})
+	}
+}
+
+// refill makes rdr read c, starting with what prev has buffered. These bytes
+// are buffered by rdr at once, so whenever rdr has nothing buffered c can be
+// read directly.
+func refill(rdr, prev *bufio.Reader, c io.Reader) {
+	buffered, _ := prev.Peek(prev.Buffered())
+	rdr.Reset(io.MultiReader(bytes.NewReader(append([]byte{}, buffered...)), c))
+	rdr.Peek(len(buffered))
+}
+
+// detectHandshake detects the protocol of c, peeking with rdr or, when a
+// detector needs more than rdr holds, e.g. for a long HTTP request line, with
+// a reader of _maxLineSize bytes which replaces it. readerDone is called
+// then, as rdr is not needed anymore.
+func detectHandshake(rdr *bufio.Reader, readerDone func(), c io.Reader, tls bool) (protocol, *bufio.Reader, error) {
+	proto, err := detectProtocol(rdr, tls)
+	if err != bufio.ErrBufferFull || rdr.Size() >= _maxLineSize {
+		if err == bufio.ErrBufferFull {
+			// the line is refused as too long by the protocol detected
+			err = nil
+		}
+		return proto, rdr, err
+	}
+	long := bufio.NewReaderSize(nil, _maxLineSize)
+	refill(long, rdr, c)
+	readerDone()
+	proto, err = detectProtocol(long, tls)
+	if err == bufio.ErrBufferFull {
+		err = nil
+	}
+	return proto, long, err
+}
+
+// readLine reads a line of up to _maxLineSize bytes, which may be longer
+// than the buffer of rdr. As with ReadLine, the line is only valid until
+// the next read.
+func readLine(rdr *bufio.Reader) ([]byte, error) {
+	line, isPrefix, err := rdr.ReadLine()
+	if err != nil || !isPrefix {
+		return line, err
+	}
+	long := append([]byte{}, line...)
+	for isPrefix {
+		if len(long) > _maxLineSize {
+			return nil, errLineTooLong
+		}
+		line, isPrefix, err = rdr.ReadLine()
+		if err != nil {
+			return nil, err
+		}
+		long = append(long, line...)
+	}
+	if len(long) > _maxLineSize {
+		return nil, errLineTooLong
+	}
+	return long, nil
+}
+
+// flushBuffered writes what rdr has read ahead to w, so the connection
+// below rdr can be read directly afterwards
+func flushBuffered(w io.Writer, rdr *bufio.Reader) error {
+	if rdr.Buffered() == 0 {
+		return nil
+	}
+	buffered, _ := rdr.Peek(rdr.Buffered())
+	if _, err := w.Write(buffered); err != nil {
+		return err
+	}
+	rdr.Discard(len(buffered))
+	return nil
+}
+
+// waitReadable waits for src to have data, an error or EOF to read, so idle
+// connections hold no pipe buffer. It returns at once if it cannot tell.
+func waitReadable(src io.Reader, srcconn net.Conn) error {
+	if rdr, ok := src.(*bufio.Reader); ok {
+		if rdr.Buffered() > 0 {
+			return nil
+		}
+	} else if src != srcconn {
+		return nil
+	}
+	tcp := tcpConnOf(srcconn)
+	if tcp == nil {
+		return nil
+	}
+	return waitTCPReadable(tcp)
+}
+
+// pipeOnce copies what src has to dst with a pooled buffer
+func pipeOnce(dst io.Writer, src io.Reader) error {
+	buf := _pipeBufs.Get().(*[]byte)
+	defer _pipeBufs.Put(buf)
+	nr, er := src.Read(*buf)
+	if nr > 0 {
+		nw, ew := dst.Write((*buf)[:nr])
+		if ew != nil {
+			return ew
+		}
+		if nr != nw {
+			return io.ErrShortWrite
+		}
+	}
+	return er
+}
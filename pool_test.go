@@ -0,0 +1,135 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestHandshakeLongLine(t *testing.T) {
+	// longer than the handshake reader, still a line
+	testProtocol([]byte(strings.Repeat("A", 3000)+"\n"), []byte("4106"))
+	testProtocol([]byte(strings.Repeat("A", _maxLineSize+1)+"\n"), []byte("4104"))
+
+	// an HTTP request line longer than the handshake reader is still told
+	// from the text protocol
+	testProtocol([]byte("GET /"+strings.Repeat("a", 1100)+" HTTP/1.1\r\nHost: a\r\n\r\n"),
+		[]byte("HTTP/1.1 400 Bad Request\r\nConnection: close\r\nContent-Type: text/plain\r\nContent-Length: 4\r\n\r\n4108"))
+}
+
+func TestBufferedConnDrain(t *testing.T) {
+	c, s := tcpPair()
+	defer c.Close()
+	defer s.Close()
+	c.Write([]byte("ahead"))
+
+	rdr, readerDone := newHandshakeReader(s)
+	if _, err := rdr.Peek(5); err != nil {
+		t.Fatal(err)
+	}
+	tlsRdr, tlsReaderDone := newTLSReader(rdr, s)
+	readerDone()
+	var given bool
+	bc := &bufferedConn{s, tlsRdr, func() { given = true; tlsReaderDone() }}
+
+	// what was read ahead comes first, then the reader is given back
+	buf := make([]byte, 16)
+	n, err := bc.Read(buf)
+	if err != nil || string(buf[:n]) != "ahead" || given {
+		t.Fatalf("unexpected %q %v %v", buf[:n], err, given)
+	}
+	c.Write([]byte("later"))
+	s.SetDeadline(time.Now().Add(time.Second * 5))
+	n, err = bc.Read(buf)
+	if err != nil || string(buf[:n]) != "later" || !given {
+		t.Fatalf("unexpected %q %v %v", buf[:n], err, given)
+	}
+}
+
+func TestHandshakeReadAhead(t *testing.T) {
+	b, err := encryptText(_echoServerAddr, _secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := net.Dial("tcp", _defaultFrontdAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	// sent along with the cipher address, read ahead by the handshake reader
+	conn.Write(append(append(b, '\n'), "ping"...))
+	conn.SetDeadline(time.Now().Add(time.Second * 5))
+	buf := make([]byte, 4)
+	if _, err := io.ReadFull(conn, buf); err != nil {
+		t.Fatal(err)
+	}
+	if string(buf) != "ping" {
+		t.Fatalf("unexpected %q", buf)
+	}
+	testEchoRound(conn)
+}
+
+func TestPipeIdle(t *testing.T) {
+	in, out := relayPair(false)
+	defer in.Close()
+	defer out.Close()
+
+	// the relay waits without a buffer and wakes up for data
+	time.Sleep(time.Millisecond * 50)
+	data := bytes.Repeat([]byte("x"), _pipeBufSize*3)
+	go in.Write(data)
+	got := make([]byte, len(data))
+	out.SetDeadline(time.Now().Add(time.Second * 5))
+	if _, err := io.ReadFull(out, got); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Fatal("corrupted")
+	}
+}
+
+// BenchmarkConnMemory reports the memory held by idle tunnels through
+// frontd, the echo server and the client ends included. It opens up to 2000
+// tunnels, e.g. go test -run NONE -bench ConnMemory -benchtime 2000x
+func BenchmarkConnMemory(b *testing.B) {
+	benchmarkConnMemory(b, _defaultFrontdAddr)
+}
+
+func benchmarkConnMemory(b *testing.B, addr string) {
+	n := b.N
+	if n > 2000 {
+		n = 2000
+	}
+	cipherAddr, err := encryptText(_echoServerAddr, _secret)
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	var before, after runtime.MemStats
+	runtime.GC()
+	runtime.ReadMemStats(&before)
+	conns := make([]net.Conn, 0, n)
+	for i := 0; i < n; i++ {
+		conn, err := net.Dial("tcp", addr)
+		if err != nil {
+			b.Fatal(err)
+		}
+		conn.Write(append(cipherAddr, '\n'))
+		testEchoRound(conn)
+		conns = append(conns, conn)
+	}
+	time.Sleep(time.Millisecond * 100)
+	runtime.GC()
+	runtime.ReadMemStats(&after)
+
+	used := int64(after.HeapInuse+after.StackInuse) - int64(before.HeapInuse+before.StackInuse)
+	b.ReportMetric(float64(used)/float64(n), "B/conn")
+	for _, conn := range conns {
+		conn.Close()
+	}
+}
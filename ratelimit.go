@@ -0,0 +1,209 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"time"
+)
+
+var (
+	// new connections per second and burst per client IP and per subnet,
+	// 0 means unlimited
+	_ConnRatePerIP      float64
+	_ConnBurstPerIP     float64
+	_ConnRatePerSubnet  float64
+	_ConnBurstPerSubnet float64
+	// concurrent connections per client IP, 0 means unlimited
+	_MaxConnPerIP int
+
+	// client limits of the listening ports, set up from the above by main
+	_clientLimiter = newClientLimiter(clientLimits{})
+)
+
+var (
+	errRateLimited     = errors.New("client connection rate exceeded")
+	errTooManyConns    = errors.New("client concurrent connections exceeded")
+	_subnetMaskV4      = net.CIDRMask(24, 32)
+	_subnetMaskV6      = net.CIDRMask(64, 128)
+	_limiterSweepEvery = time.Minute
+)
+
+// tokenBucket allows rate events per second with bursts of up to burst
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+func (b *tokenBucket) take(now time.Time, rate, burst float64) bool {
+	if b.last.IsZero() {
+		b.tokens = burst
+	} else {
+		b.tokens += now.Sub(b.last).Seconds() * rate
+		if b.tokens > burst {
+			b.tokens = burst
+		}
+	}
+	b.last = now
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// full tells if the bucket is back to its burst, so it can be forgotten
+func (b *tokenBucket) full(now time.Time, rate, burst float64) bool {
+	return b.tokens+now.Sub(b.last).Seconds()*rate >= burst
+}
+
+// clientLimits are the new connections per second and burst per client IP
+// and per subnet, and the concurrent connections per client IP. 0 means
+// unlimited.
+type clientLimits struct {
+	ratePerIP      float64
+	burstPerIP     float64
+	ratePerSubnet  float64
+	burstPerSubnet float64
+	maxConnPerIP   int
+}
+
+// clientLimiter enforces the per client IP and per subnet limits. A nil one
+// limits nobody.
+type clientLimiter struct {
+	limits clientLimits
+
+	mu      sync.Mutex
+	ips     map[string]*tokenBucket
+	subnets map[string]*tokenBucket
+	conns   map[string]int
+}
+
+func newClientLimiter(limits clientLimits) *clientLimiter {
+	return &clientLimiter{
+		limits:  limits,
+		ips:     make(map[string]*tokenBucket),
+		subnets: make(map[string]*tokenBucket),
+		conns:   make(map[string]int),
+	}
+}
+
+func (l *clientLimiter) enabled() bool {
+	return l != nil && (l.limits.ratePerIP > 0 || l.limits.ratePerSubnet > 0 || l.limits.maxConnPerIP > 0)
+}
+
+// clientIP returns the IP of a remote address
+func clientIP(addr net.Addr) net.IP {
+	switch a := addr.(type) {
+	case *net.TCPAddr:
+		return a.IP
+	}
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return nil
+	}
+	return net.ParseIP(host)
+}
+
+// admitClient checks a new connection from c against the client limits. The
+// returned function has to be called once the connection is done.
+func (l *clientLimiter) admitClient(c net.Conn) (release func(), err error) {
+	if !l.enabled() {
+		return func() {}, nil
+	}
+	ip := clientIP(c.RemoteAddr())
+	if ip == nil {
+		return func() {}, nil
+	}
+	return l.admit(ip, time.Now())
+}
+
+func (l *clientLimiter) admit(ip net.IP, now time.Time) (func(), error) {
+	key := ip.String()
+	var subnet string
+	if ip4 := ip.To4(); ip4 != nil {
+		subnet = ip4.Mask(_subnetMaskV4).String()
+	} else {
+		subnet = ip.Mask(_subnetMaskV6).String()
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.limits.maxConnPerIP > 0 && l.conns[key] >= l.limits.maxConnPerIP {
+		countMetric("client_rejected_concurrency")
+		return nil, errTooManyConns
+	}
+
+	if l.limits.ratePerIP > 0 {
+		b, ok := l.ips[key]
+		if !ok {
+			b = &tokenBucket{}
+			l.ips[key] = b
+		}
+		if !b.take(now, l.limits.ratePerIP, l.limits.burstPerIP) {
+			countMetric("client_rejected_rate_ip")
+			return nil, errRateLimited
+		}
+	}
+
+	if l.limits.ratePerSubnet > 0 {
+		b, ok := l.subnets[subnet]
+		if !ok {
+			b = &tokenBucket{}
+			l.subnets[subnet] = b
+		}
+		if !b.take(now, l.limits.ratePerSubnet, l.limits.burstPerSubnet) {
+			countMetric("client_rejected_rate_subnet")
+			return nil, errRateLimited
+		}
+	}
+
+	if l.limits.maxConnPerIP == 0 {
+		return func() {}, nil
+	}
+	l.conns[key]++
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			l.mu.Lock()
+			if l.conns[key]--; l.conns[key] <= 0 {
+				delete(l.conns, key)
+			}
+			l.mu.Unlock()
+		})
+	}, nil
+}
+
+// clientConn releases the limits of its client once closed
+type clientConn struct {
+	net.Conn
+	done func()
+}
+
+func (c *clientConn) Close() error {
+	c.done()
+	return c.Conn.Close()
+}
+
+// sweep forgets the buckets which are full again
+func (l *clientLimiter) sweep(now time.Time) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for k, b := range l.ips {
+		if b.full(now, l.limits.ratePerIP, l.limits.burstPerIP) {
+			delete(l.ips, k)
+		}
+	}
+	for k, b := range l.subnets {
+		if b.full(now, l.limits.ratePerSubnet, l.limits.burstPerSubnet) {
+			delete(l.subnets, k)
+		}
+	}
+}
+
+func sweepClientLimiter(l *clientLimiter) {
+	for range time.Tick(_limiterSweepEvery) {
+		l.sweep(time.Now())
+	}
+}
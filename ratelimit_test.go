@@ -0,0 +1,88 @@
+package main
+
+import (
+	"expvar"
+	"io/ioutil"
+	"net"
+	"testing"
+	"time"
+)
+
+func metricValue(name string) int64 {
+	if v, ok := _metrics.Get(name).(*expvar.Int); ok {
+		return v.Value()
+	}
+	return 0
+}
+
+func TestClientLimiterRate(t *testing.T) {
+	l := newClientLimiter(clientLimits{ratePerIP: 1, burstPerIP: 2, ratePerSubnet: 10, burstPerSubnet: 3})
+	now := time.Now()
+	a, b := net.ParseIP("10.0.0.1"), net.ParseIP("10.0.0.2")
+
+	// burst of 2 per IP
+	for i := 0; i < 2; i++ {
+		if _, err := l.admit(a, now); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := l.admit(a, now); err != errRateLimited {
+		t.Fatalf("expected rate limit, got %v", err)
+	}
+
+	// burst of 3 per /24
+	if _, err := l.admit(b, now); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := l.admit(b, now); err != errRateLimited {
+		t.Fatalf("expected subnet rate limit, got %v", err)
+	}
+	if _, err := l.admit(net.ParseIP("10.0.1.1"), now); err != nil {
+		t.Fatal(err)
+	}
+
+	// refilled a second later
+	if _, err := l.admit(a, now.Add(time.Second)); err != nil {
+		t.Fatal(err)
+	}
+
+	l.sweep(now.Add(time.Hour))
+	if len(l.ips) != 0 || len(l.subnets) != 0 {
+		t.Fatalf("buckets not swept: %d %d", len(l.ips), len(l.subnets))
+	}
+}
+
+func TestClientLimiterConcurrency(t *testing.T) {
+	addr, stop := startListener(t, &listener{clients: newClientLimiter(clientLimits{maxConnPerIP: 1})})
+	defer stop()
+
+	rejected := metricValue("client_rejected_concurrency")
+
+	b, err := encryptText(_echoServerAddr, _secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn := dialListener(t, addr)
+	conn.Write(append(b, '\n'))
+	testEchoRound(conn)
+
+	other := dialListener(t, addr)
+	other.Write(append(b, '\n'))
+	if got, _ := ioutil.ReadAll(other); string(got) != "4110" {
+		t.Fatalf("expected 4110, got %q", got)
+	}
+	other.Close()
+	if metricValue("client_rejected_concurrency") != rejected+1 {
+		t.Fatal("rejection not counted")
+	}
+	// other listeners keep their own limits
+	testProtocol(append(b, '\n'), nil)
+
+	// the slot is given back when the connection is done
+	conn.Close()
+	time.Sleep(time.Millisecond * 100)
+	conn = dialListener(t, addr)
+	defer conn.Close()
+	conn.Write(append(b, '\n'))
+	testEchoRound(conn)
+}
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"errors"
+	"expvar"
+	"sync/atomic"
+	"time"
+)
+
+var errDetached = errors.New("tunnel handed over to the relay engine")
+
+var (
+	// how the listening ports relay their tunnels, set up by main
+	_relayConfig = &relayConfig{splice: true, halfCloseTimeout: _HalfCloseTimeout}
+
+	// tunnels held by the relay engines
+	_relayTunnels int64
+)
+
+// how often the relay engine checks half-closed tunnels for their timeout
+const _relaySweepEvery = time.Second
+
+// relayConfig is how the tunnels of a listener are relayed once set up
+type relayConfig struct {
+	// with splice(2) where available, see splice_linux.go
+	splice bool
+	// relays idle tunnels on a few epoll workers instead of two goroutines
+	// each, nil unless RELAY_WORKERS is set
+	engine *relayEngine
+	// a half-closed tunnel is closed once idle for halfCloseTimeout
+	halfCloseTimeout time.Duration
+}
+
+func init() {
+	_metrics.Set("relay_tunnels", expvar.Func(func() interface{} {
+		return atomic.LoadInt64(&_relayTunnels)
+	}))
+}
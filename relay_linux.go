@@ -0,0 +1,323 @@
+//go:build linux
+// +build linux
+
+package main
+
+import (
+	"log"
+	"net"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// relayEngine relays tunnels of plain TCP connections with epoll, the way
+// reuse/poll waits for a socket, but for many sockets at once. A tunnel
+// costs no goroutine and holds a buffer only while a write to one side is
+// pending.
+type relayEngine struct {
+	workers []*relayWorker
+	next    uint32
+}
+
+type relayWorker struct {
+	epfd int
+	// how often half-closed tunnels are checked for their timeout
+	sweepEvery time.Duration
+
+	mu   sync.Mutex
+	ends map[int]*relayEnd
+	// ends of half-closed tunnels still read from
+	halfOpen map[*relayEnd]bool
+}
+
+// relayEnd is one side of a tunnel, only used by its worker once added
+type relayEnd struct {
+	fd   int
+	conn net.Conn
+	peer *relayEnd
+	// read from the peer and not written to this side yet, the peer is not
+	// read from meanwhile
+	pending []byte
+	buf     *[]byte
+	// waiting for this side to be writable
+	waiting bool
+	// this side sent FIN, passed on to the peer
+	eof bool
+	// this side hung up while its data waited for the peer. It is not
+	// waited for anymore, what it sent is read once the peer took the
+	// pending data and what is sent to it is dropped.
+	hup bool
+	// last read from, once the tunnel is half-closed
+	last time.Time
+	// the tunnel is closed once half-closed and idle for halfCloseTimeout
+	halfCloseTimeout time.Duration
+	closed           bool
+}
+
+func newRelayEngine(n int, sweepEvery time.Duration) (*relayEngine, error) {
+	e := &relayEngine{}
+	for i := 0; i < n; i++ {
+		epfd, err := syscall.EpollCreate1(syscall.EPOLL_CLOEXEC)
+		if err != nil {
+			return nil, err
+		}
+		w := &relayWorker{
+			epfd:       epfd,
+			sweepEvery: sweepEvery,
+			ends:       make(map[int]*relayEnd),
+			halfOpen:   make(map[*relayEnd]bool),
+		}
+		e.workers = append(e.workers, w)
+		go w.run()
+	}
+	return e, nil
+}
+
+// add hands a tunnel over to a worker, which closes both connections when
+// done. It returns false if the connections are not plain TCP.
+func (e *relayEngine) add(c, backend net.Conn, halfCloseTimeout time.Duration) bool {
+	cfd, ok := connFd(c)
+	if !ok {
+		return false
+	}
+	bfd, ok := connFd(backend)
+	if !ok {
+		return false
+	}
+	a := &relayEnd{fd: cfd, conn: c, halfCloseTimeout: halfCloseTimeout}
+	b := &relayEnd{fd: bfd, conn: backend, peer: a, halfCloseTimeout: halfCloseTimeout}
+	a.peer = b
+
+	w := e.workers[atomic.AddUint32(&e.next, 1)%uint32(len(e.workers))]
+	// locked until both are added, the worker may get events of a already
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.ends[cfd], w.ends[bfd] = a, b
+	atomic.AddInt64(&_relayTunnels, 1)
+	for _, end := range []*relayEnd{a, b} {
+		if err := w.ctl(syscall.EPOLL_CTL_ADD, end, end.events()); err != nil {
+			log.Println("relay:", err)
+			w.close(a)
+			break
+		}
+	}
+	return true
+}
+
+// connFd returns the socket of a plain TCP connection. The connection must
+// not be used elsewhere afterwards.
+func connFd(c net.Conn) (int, bool) {
+	tcp := tcpConnOf(c)
+	if tcp == nil {
+		return 0, false
+	}
+	rc, err := tcp.SyscallConn()
+	if err != nil {
+		return 0, false
+	}
+	fd := -1
+	rc.Control(func(s uintptr) {
+		fd = int(s)
+	})
+	return fd, fd >= 0
+}
+
+func (w *relayWorker) ctl(op int, end *relayEnd, events uint32) error {
+	ev := syscall.EpollEvent{Events: events, Fd: int32(end.fd)}
+	return syscall.EpollCtl(w.epfd, op, end.fd, &ev)
+}
+
+// events are what end is waited for: data unless it sent FIN or its peer
+// has a write pending, and room to write its own pending bytes
+func (end *relayEnd) events() uint32 {
+	var events uint32
+	if !end.eof && end.peer.pending == nil {
+		events |= syscall.EPOLLIN | syscall.EPOLLRDHUP
+	}
+	if end.waiting {
+		events |= syscall.EPOLLOUT
+	}
+	return events
+}
+
+// update waits for the events of both sides of the tunnel of end, locked
+func (w *relayWorker) update(end *relayEnd) {
+	for _, e := range []*relayEnd{end, end.peer} {
+		if !e.hup && w.ctl(syscall.EPOLL_CTL_MOD, e, e.events()) != nil {
+			w.close(end)
+			return
+		}
+	}
+}
+
+func (w *relayWorker) run() {
+	var events [128]syscall.EpollEvent
+	for {
+		timeout := -1
+		w.mu.Lock()
+		if len(w.halfOpen) > 0 {
+			timeout = int(w.sweepEvery / time.Millisecond)
+		}
+		w.mu.Unlock()
+		n, err := syscall.EpollWait(w.epfd, events[:], timeout)
+		if err == syscall.EINTR {
+			continue
+		}
+		if err != nil {
+			log.Fatal("relay: ", err)
+		}
+		w.mu.Lock()
+		for _, ev := range events[:n] {
+			end, ok := w.ends[int(ev.Fd)]
+			if !ok || end.closed {
+				continue
+			}
+			if ev.Events&syscall.EPOLLOUT != 0 {
+				w.flush(end)
+				if !end.closed && end.pending == nil && end.peer.hup {
+					w.read(end.peer)
+				}
+			}
+			if end.closed {
+				continue
+			}
+			// reported even while not read from
+			if ev.Events&(syscall.EPOLLHUP|syscall.EPOLLERR) != 0 && end.eof {
+				w.close(end)
+			} else if ev.Events&(syscall.EPOLLHUP|syscall.EPOLLERR) != 0 && end.peer.pending != nil {
+				w.hangUp(end)
+			} else if ev.Events&(syscall.EPOLLIN|syscall.EPOLLRDHUP|syscall.EPOLLHUP|syscall.EPOLLERR) != 0 {
+				w.read(end)
+			}
+		}
+		w.sweep(time.Now())
+		w.mu.Unlock()
+	}
+}
+
+// sweep closes the half-closed tunnels idle for their timeout, locked
+func (w *relayWorker) sweep(now time.Time) {
+	for end := range w.halfOpen {
+		if now.Sub(end.last) >= end.halfCloseTimeout {
+			w.close(end)
+		}
+	}
+}
+
+// hangUp stops waiting for end, which hung up before its peer took what it
+// sent. The data pending for the peer is still written, locked.
+func (w *relayWorker) hangUp(end *relayEnd) {
+	end.hup = true
+	syscall.EpollCtl(w.epfd, syscall.EPOLL_CTL_DEL, end.fd, nil)
+	if end.buf != nil {
+		_pipeBufs.Put(end.buf)
+		end.pending, end.buf = nil, nil
+	}
+	end.waiting = false
+	w.update(end)
+}
+
+// read relays what src has to its peer, locked. A side which hung up is
+// read until it is drained or its peer has to be waited for again.
+func (w *relayWorker) read(src *relayEnd) {
+	dst := src.peer
+	for !src.closed && !src.eof && dst.pending == nil {
+		buf := _pipeBufs.Get().(*[]byte)
+		n, err := syscall.Read(src.fd, *buf)
+		if err == syscall.EINTR {
+			_pipeBufs.Put(buf)
+			continue
+		}
+		if err == syscall.EAGAIN && !src.hup {
+			_pipeBufs.Put(buf)
+			return
+		}
+		if err != nil || n <= 0 {
+			_pipeBufs.Put(buf)
+			if err != nil {
+				w.close(src)
+			} else {
+				w.halfClose(src)
+			}
+			return
+		}
+		if dst.eof {
+			src.last = time.Now()
+		}
+		if dst.hup {
+			_pipeBufs.Put(buf)
+			return
+		}
+		dst.pending, dst.buf = (*buf)[:n], buf
+		w.flush(dst)
+		if !src.hup {
+			return
+		}
+	}
+}
+
+// halfClose passes the FIN src sent on to its peer, the tunnel is closed
+// once both sides sent one, locked
+func (w *relayWorker) halfClose(src *relayEnd) {
+	dst := src.peer
+	src.eof = true
+	delete(w.halfOpen, src)
+	if dst.eof || syscall.Shutdown(dst.fd, syscall.SHUT_WR) != nil {
+		w.close(src)
+		return
+	}
+	countMetric("relay_half_closed")
+	dst.last = time.Now()
+	w.halfOpen[dst] = true
+	w.update(src)
+}
+
+// flush writes what is pending for dst. While it cannot be written at once,
+// dst is waited for to be writable and its peer is not read from.
+func (w *relayWorker) flush(dst *relayEnd) {
+	for len(dst.pending) > 0 {
+		n, err := syscall.Write(dst.fd, dst.pending)
+		if err == syscall.EINTR {
+			continue
+		}
+		if err == syscall.EAGAIN {
+			if !dst.waiting {
+				dst.waiting = true
+				w.update(dst)
+			}
+			return
+		}
+		if err != nil {
+			w.close(dst)
+			return
+		}
+		dst.pending = dst.pending[n:]
+	}
+	_pipeBufs.Put(dst.buf)
+	dst.pending, dst.buf = nil, nil
+	if dst.waiting {
+		dst.waiting = false
+		w.update(dst)
+	}
+}
+
+// close ends the tunnel of end, locked
+func (w *relayWorker) close(end *relayEnd) {
+	if end.closed {
+		return
+	}
+	atomic.AddInt64(&_relayTunnels, -1)
+	for _, e := range []*relayEnd{end, end.peer} {
+		e.closed = true
+		syscall.EpollCtl(w.epfd, syscall.EPOLL_CTL_DEL, e.fd, nil)
+		delete(w.ends, e.fd)
+		delete(w.halfOpen, e)
+		if e.buf != nil {
+			_pipeBufs.Put(e.buf)
+			e.pending, e.buf = nil, nil
+		}
+		e.conn.Close()
+	}
+}
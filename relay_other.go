@@ -0,0 +1,21 @@
+//go:build !linux
+// +build !linux
+
+package main
+
+import (
+	"errors"
+	"net"
+	"time"
+)
+
+// relayEngine needs epoll, tunnels are relayed by goroutines elsewhere
+type relayEngine struct{}
+
+func newRelayEngine(n int, sweepEvery time.Duration) (*relayEngine, error) {
+	return nil, errors.New("the relay engine requires Linux")
+}
+
+func (e *relayEngine) add(c, backend net.Conn, halfCloseTimeout time.Duration) bool {
+	return false
+}
@@ -0,0 +1,198 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// startRelayListener starts a listener relaying its tunnels with a relay
+// engine of n workers
+func startRelayListener(t testing.TB, n int) (addr string, e *relayEngine, stop func()) {
+	e, err := newRelayEngine(n, _relaySweepEvery)
+	if err != nil {
+		t.Skip(err)
+	}
+	addr, stop = startListener(t, &listener{relay: &relayConfig{engine: e, halfCloseTimeout: time.Minute}})
+	return addr, e, stop
+}
+
+func TestRelayEngine(t *testing.T) {
+	addr, e, stop := startRelayListener(t, 2)
+	defer stop()
+
+	b, err := encryptText(_echoServerAddr, _secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tunnels := atomic.LoadInt64(&_relayTunnels)
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Write(append(b, '\n'))
+	testEchoRound(conn)
+	if atomic.LoadInt64(&_relayTunnels) != tunnels+1 {
+		t.Fatal("tunnel not relayed by the engine")
+	}
+
+	// more than the socket buffers hold, the writes have to wait
+	data := make([]byte, 8<<20)
+	rand.Read(data)
+	go conn.Write(data)
+	got := make([]byte, len(data))
+	conn.SetDeadline(time.Now().Add(time.Second * 10))
+	if _, err := io.ReadFull(conn, got); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Fatal("corrupted")
+	}
+	testEchoRound(conn)
+
+	// the tunnel is given back once closed
+	conn.Close()
+	waitFor(t, "tunnel not closed", func() bool {
+		return atomic.LoadInt64(&_relayTunnels) == tunnels
+	})
+
+	// and so is the slot of the client
+	client, c := tcpPair()
+	backend, b2 := tcpPair()
+	released := make(chan struct{})
+	if !e.add(&clientConn{c, func() { close(released) }}, backend, time.Minute) {
+		t.Fatal("tunnel not added")
+	}
+	client.Close()
+	b2.Close()
+	select {
+	case <-released:
+	case <-time.After(time.Second * 5):
+		t.Fatal("client slot not given back")
+	}
+}
+
+func TestRelayEngineBulk(t *testing.T) {
+	addr, _, stop := startRelayListener(t, 1)
+	defer stop()
+
+	up := make([]byte, 16<<20)
+	down := make([]byte, 16<<20)
+	rand.Read(up)
+	rand.Read(down)
+
+	// the backend sends while it receives, so both directions of the tunnel
+	// are waiting for their peers at once
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	received := make(chan error, 1)
+	go func() {
+		c, err := l.Accept()
+		if err != nil {
+			received <- err
+			return
+		}
+		defer c.Close()
+		c.SetDeadline(time.Now().Add(time.Second * 20))
+		go c.Write(down)
+		got := make([]byte, len(up))
+		if _, err := io.ReadFull(c, got); err != nil {
+			received <- err
+			return
+		}
+		if !bytes.Equal(got, up) {
+			err = errors.New("upstream corrupted")
+		}
+		received <- err
+	}()
+
+	b, err := encryptText([]byte(l.Addr().String()), _secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tunnels := atomic.LoadInt64(&_relayTunnels)
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(time.Second * 20))
+	conn.Write(append(b, '\n'))
+	waitFor(t, "tunnel not relayed by the engine", func() bool {
+		return atomic.LoadInt64(&_relayTunnels) == tunnels+1
+	})
+
+	go conn.Write(up)
+	got := make([]byte, len(down))
+	if _, err := io.ReadFull(conn, got); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, down) {
+		t.Fatal("downstream corrupted")
+	}
+	if err := <-received; err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+	waitFor(t, "tunnel not closed", func() bool {
+		return atomic.LoadInt64(&_relayTunnels) == tunnels
+	})
+}
+
+func TestRelayEngineHangUp(t *testing.T) {
+	e, err := newRelayEngine(1, _relaySweepEvery)
+	if err != nil {
+		t.Skip(err)
+	}
+	client, c := tcpPair()
+	defer client.Close()
+	backend, b := tcpPair()
+	defer backend.Close()
+	// the backend takes little, the client side holds the rest
+	backend.(*net.TCPConn).SetReadBuffer(4096)
+	b.(*net.TCPConn).SetWriteBuffer(4096)
+	c.(*net.TCPConn).SetReadBuffer(1 << 20)
+	tunnels := atomic.LoadInt64(&_relayTunnels)
+	if !e.add(c, b, time.Minute) {
+		t.Fatal("tunnel not added")
+	}
+
+	data := make([]byte, 256<<10)
+	rand.Read(data)
+	client.Write(data)
+	client.(*net.TCPConn).CloseWrite()
+	time.Sleep(time.Millisecond * 200)
+
+	// the FIN of the backend is passed on, so the client side hangs up while
+	// its data still waits for the backend
+	backend.(*net.TCPConn).CloseWrite()
+	time.Sleep(time.Millisecond * 200)
+
+	backend.SetDeadline(time.Now().Add(time.Second * 10))
+	got, err := ioutil.ReadAll(backend)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Fatalf("%d of %d bytes relayed", len(got), len(data))
+	}
+	waitFor(t, "tunnel not closed", func() bool {
+		return atomic.LoadInt64(&_relayTunnels) == tunnels
+	})
+}
+
+// BenchmarkRelayConnMemory is BenchmarkConnMemory with the relay engine
+func BenchmarkRelayConnMemory(b *testing.B) {
+	addr, _, stop := startRelayListener(b, 2)
+	defer stop()
+	benchmarkConnMemory(b, addr)
+}
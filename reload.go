@@ -0,0 +1,91 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// how often hot reloadable files are checked for changes
+var _reloadEvery = time.Second * 5
+
+// loadAndWatch loads the file at path, then reloads it whenever it changes.
+// Only the first load may fail, a bad edit later on is logged and the last
+// good version stays in use. stop ends the watching.
+func loadAndWatch(path string, load func(path string) error) (stop func(), err error) {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	if err := load(path); err != nil {
+		return nil, err
+	}
+	done := make(chan struct{})
+	go watchFile(path, fi, load, done)
+	var once sync.Once
+	return func() { once.Do(func() { close(done) }) }, nil
+}
+
+// readConfigLines calls parse with the fields of every line of the file at
+// path. Empty lines and lines starting with # are skipped, an error of parse
+// is returned along with the line it is about.
+func readConfigLines(path string, parse func(fields []string) error) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	s := bufio.NewScanner(f)
+	for n := 1; s.Scan(); n++ {
+		line := strings.TrimSpace(s.Text())
+		if len(line) == 0 || line[0] == '#' {
+			continue
+		}
+		if err := parse(strings.Fields(line)); err != nil {
+			return fmt.Errorf("%s:%d: %v", path, n, err)
+		}
+	}
+	return s.Err()
+}
+
+// watchFile polls the modification time and size of a file, files are best
+// replaced by renaming a new version over them. It returns once done is
+// closed.
+func watchFile(path string, last os.FileInfo, load func(path string) error, done <-chan struct{}) {
+	ticker := time.NewTicker(_reloadEvery)
+	defer ticker.Stop()
+	var missing bool
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+		}
+		fi, err := os.Stat(path)
+		if err != nil {
+			if !missing {
+				log.Println("reload:", err)
+			}
+			missing = true
+			continue
+		}
+		missing = false
+		if fi.ModTime().Equal(last.ModTime()) && fi.Size() == last.Size() {
+			continue
+		}
+		last = fi
+
+		if err := load(path); err != nil {
+			countMetric("reload_errors")
+			log.Println("reload:", path, err)
+			continue
+		}
+		countMetric("reloads")
+		log.Println("reloaded", path)
+	}
+}
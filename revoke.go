@@ -0,0 +1,162 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"expvar"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync/atomic"
+)
+
+var errRevoked = errors.New("token revoked")
+
+var (
+	// path of the revocation list file, refusing leaked tokens without
+	// rotating SECRET
+	_RevocationList string
+
+	// revocationList, replaced as a whole on reload
+	_revocations atomic.Value
+	// hits by kind of entry: token, addr and kid
+	_revokedHits = new(expvar.Map).Init()
+)
+
+// revocationList holds the revoked token fingerprints, the SHA-256 of the
+// decoded cipher texts, backend addresses and key IDs
+type revocationList struct {
+	tokens map[[sha256.Size]byte]bool
+	addrs  map[string]bool
+	kids   map[string]bool
+}
+
+func init() {
+	_revocations.Store(&revocationList{})
+	_metrics.Set("revoked_hits", _revokedHits)
+	http.HandleFunc("/admin/revocations", serveAdminRevocations)
+}
+
+// revokedToken tells if the fingerprint of a cipher text is revoked. It is
+// checked before the address cache, so a revoked token costs no decryption.
+func revokedToken(cipherAddr []byte) bool {
+	l := _revocations.Load().(*revocationList)
+	if len(l.tokens) == 0 || !l.tokens[sha256.Sum256(cipherAddr)] {
+		return false
+	}
+	_revokedHits.Add("token", 1)
+	return true
+}
+
+// revokedTarget tells if a decrypted target names a revoked backend address
+// or carries a revoked key ID
+func revokedTarget(target, kid string) bool {
+	l := _revocations.Load().(*revocationList)
+	if len(kid) > 0 && l.kids[kid] {
+		_revokedHits.Add("kid", 1)
+		return true
+	}
+	if len(l.addrs) == 0 {
+		return false
+	}
+	if i := strings.IndexByte(target, '?'); i >= 0 {
+		target = target[:i]
+	}
+	for _, addr := range strings.Split(target, ",") {
+		if l.addrs[strings.TrimSpace(addr)] {
+			_revokedHits.Add("addr", 1)
+			return true
+		}
+	}
+	return false
+}
+
+// dropRevoked returns the backend addresses which are not revoked. It is
+// applied to the targets mapped and resolved just before dialing, so a
+// revoked address is not reached through a rewrite, canary or route either.
+func dropRevoked(addrs []string) []string {
+	l := _revocations.Load().(*revocationList)
+	if len(l.addrs) == 0 {
+		return addrs
+	}
+	var kept []string
+	for _, addr := range addrs {
+		if l.addrs[addr] {
+			_revokedHits.Add("addr", 1)
+			continue
+		}
+		kept = append(kept, addr)
+	}
+	return kept
+}
+
+// loadRevocationList reads a revocation list and makes it the current one.
+// Every line holds a kind and what is revoked, e.g.
+//
+//	token 9f86d081884c7d659a2feaa0c55ad015a3bf4f1b2b0b822cd15d6c15b0f00a08
+//	addr 10.0.1.5:9000
+//	kid 2023-leaked
+//
+// A token is the hex SHA-256 of its decoded cipher text, e.g. the output of
+// echo -n <cipher text> | base64 -d | sha256sum.
+func loadRevocationList(path string) error {
+	l := &revocationList{
+		tokens: make(map[[sha256.Size]byte]bool),
+		addrs:  make(map[string]bool),
+		kids:   make(map[string]bool),
+	}
+	err := readConfigLines(path, func(fields []string) error {
+		if len(fields) != 2 {
+			return errors.New("expected a kind and what is revoked")
+		}
+		switch fields[0] {
+		case "token":
+			var sum [sha256.Size]byte
+			b, err := hex.DecodeString(fields[1])
+			if err != nil || len(b) != len(sum) {
+				return fmt.Errorf("invalid token fingerprint %q", fields[1])
+			}
+			copy(sum[:], b)
+			l.tokens[sum] = true
+		case "addr":
+			l.addrs[fields[1]] = true
+		case "kid":
+			l.kids[fields[1]] = true
+		default:
+			return fmt.Errorf("unknown kind %q", fields[0])
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	_revocations.Store(l)
+	return nil
+}
+
+// revocationStatus is the revocation list as reported by the admin API
+type revocationStatus struct {
+	Tokens []string `json:"tokens"`
+	Addrs  []string `json:"addrs"`
+	Kids   []string `json:"kids"`
+}
+
+func serveAdminRevocations(w http.ResponseWriter, r *http.Request) {
+	l := _revocations.Load().(*revocationList)
+	s := revocationStatus{Tokens: []string{}, Addrs: []string{}, Kids: []string{}}
+	for sum := range l.tokens {
+		s.Tokens = append(s.Tokens, hex.EncodeToString(sum[:]))
+	}
+	for addr := range l.addrs {
+		s.Addrs = append(s.Addrs, addr)
+	}
+	for kid := range l.kids {
+		s.Kids = append(s.Kids, kid)
+	}
+	sort.Strings(s.Tokens)
+	sort.Strings(s.Addrs)
+	sort.Strings(s.Kids)
+	writeJSON(w, s)
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"expvar"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func revokedHits(kind string) int64 {
+	if v, ok := _revokedHits.Get(kind).(*expvar.Int); ok {
+		return v.Value()
+	}
+	return 0
+}
+
+func TestRevocationList(t *testing.T) {
+	_reloadEvery = time.Millisecond * 20
+	dir, err := ioutil.TempDir("", "frontd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		os.RemoveAll(dir)
+		_revocations.Store(&revocationList{})
+		_reloadEvery = time.Second * 5
+	}()
+
+	leaked, err := encryptText(_echoServerAddr, _secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	withKid, err := encryptText([]byte(string(_echoServerAddr)+"?kid=2023-leaked"), _secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	retired, err := encryptText([]byte("127.0.0.1:62869,127.0.0.1:62868?lb=first"), _secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// cached before it leaks
+	conn, err := net.Dial("tcp", _defaultFrontdAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Write(append(leaked, '\n'))
+	testEchoRound(conn)
+	conn.Close()
+
+	key, err := base64.StdEncoding.DecodeString(string(leaked))
+	if err != nil {
+		t.Fatal(err)
+	}
+	sum := sha256.Sum256(key)
+	path := filepath.Join(dir, "revoked")
+	writeFileAtomic(t, path, "token "+hex.EncodeToString(sum[:])+"\naddr 127.0.0.1:62868\nkid 2023-leaked\n")
+	stop, err := loadAndWatch(path, loadRevocationList)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stop()
+
+	for kind, b := range map[string][]byte{"token": leaked, "kid": withKid, "addr": retired} {
+		hits := revokedHits(kind)
+		testProtocol(append(b, '\n'), []byte("4114"))
+		if revokedHits(kind) != hits+1 {
+			t.Fatalf("%s hit not counted", kind)
+		}
+	}
+
+	writeFileAtomic(t, path, "kid 2024\n")
+	waitFor(t, "revocation list not reloaded", func() bool { return !revokedToken(key) })
+	for _, b := range [][]byte{leaked, withKid} {
+		conn, err := net.Dial("tcp", _defaultFrontdAddr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn.Write(append(b, '\n'))
+		testEchoRound(conn)
+		conn.Close()
+	}
+
+	for _, content := range []string{"token abc\n", "ip 10.0.0.1\n", "addr\n"} {
+		writeFileAtomic(t, path, content)
+		if err := loadRevocationList(path); err == nil {
+			t.Fatalf("%q loaded", content)
+		}
+	}
+}
+
+func TestRevokedDialTargets(t *testing.T) {
+	dir, err := ioutil.TempDir("", "frontd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		os.RemoveAll(dir)
+		_revocations.Store(&revocationList{})
+		_routes.Store(routeTable{})
+	}()
+	path := filepath.Join(dir, "revoked")
+	writeFileAtomic(t, path, "addr 127.0.0.1:62868\n")
+	if err := loadRevocationList(path); err != nil {
+		t.Fatal(err)
+	}
+	// the tokens name routes, the revoked address is only known once mapped
+	_routes.Store(routeTable{
+		"zone-1": "127.0.0.1:62868",
+		"zone-2": "127.0.0.1:62868," + string(_echoServerAddr) + "?lb=first",
+	})
+
+	b, err := encryptText([]byte("zone-1"), _secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hits := revokedHits("addr")
+	testProtocol(append(b, '\n'), []byte("4114"))
+	if revokedHits("addr") != hits+1 {
+		t.Fatal("addr hit not counted")
+	}
+
+	// the other backends of a list are still dialed
+	b, err = encryptText([]byte("zone-2"), _secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testProtocol(append(b, '\n'), nil)
+	if revokedHits("addr") != hits+2 {
+		t.Fatal("addr hit not counted")
+	}
+}
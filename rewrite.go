@@ -0,0 +1,105 @@
+package main
+
+import (
+	"expvar"
+	"net"
+	"net/http"
+	"strings"
+	"sync/atomic"
+)
+
+var (
+	// path of the rewrite map file, which moves the backends of tokens
+	// already issued
+	_RewriteMap string
+
+	// rewriteMap, replaced as a whole on reload
+	_rewrites atomic.Value
+	// hits of every rewritten target, telling when an entry can be removed
+	_rewriteHits = new(expvar.Map).Init()
+)
+
+// rewriteMap maps decrypted targets to new ones
+type rewriteMap map[string]string
+
+func init() {
+	_rewrites.Store(rewriteMap{})
+	_metrics.Set("rewrite_hits", _rewriteHits)
+	http.HandleFunc("/admin/rewrites", serveAdminRewrites)
+}
+
+// rewriteTarget returns the new target of a decrypted one, if it is
+// rewritten. The addresses of a list are rewritten one by one, by the entries
+// whose replacement is an address as well.
+func rewriteTarget(s string) string {
+	rewrites := _rewrites.Load().(rewriteMap)
+	if to, ok := rewrites[s]; ok {
+		_rewriteHits.Add(s, 1)
+		return to
+	}
+	if len(rewrites) == 0 || !strings.ContainsAny(s, ",?") || strings.Contains(s, "://") {
+		return s
+	}
+
+	list, query := s, ""
+	if i := strings.IndexByte(s, '?'); i >= 0 {
+		list, query = s[:i], s[i:]
+	}
+	addrs := strings.Split(list, ",")
+	var rewritten bool
+	for i, addr := range addrs {
+		addr = strings.TrimSpace(addr)
+		if to, ok := rewrites[addr]; ok && isAddress(to) {
+			_rewriteHits.Add(addr, 1)
+			addrs[i] = to
+			rewritten = true
+		}
+	}
+	if !rewritten {
+		return s
+	}
+	return strings.Join(addrs, ",") + query
+}
+
+// isAddress reports whether a target is a single host:port
+func isAddress(s string) bool {
+	if strings.ContainsAny(s, ",?") || strings.Contains(s, "://") {
+		return false
+	}
+	_, _, err := net.SplitHostPort(s)
+	return err == nil
+}
+
+// loadRewriteMap reads a rewrite map and makes it the current one. Every line
+// holds a decrypted target and its replacement, e.g.
+//
+//	10.0.1.5:9000 10.0.1.6:9000
+//
+// Targets are rewritten once, the replacement may be a route ID. Within a
+// list of addresses only replacements that are addresses apply.
+func loadRewriteMap(path string) error {
+	rewrites, err := readTargetFile(path, true)
+	if err != nil {
+		return err
+	}
+	_rewrites.Store(rewriteMap(rewrites))
+	return nil
+}
+
+// rewriteStatus is an entry of the rewrite map as reported by the admin API
+type rewriteStatus struct {
+	To   string `json:"to"`
+	Hits int64  `json:"hits"`
+}
+
+func serveAdminRewrites(w http.ResponseWriter, r *http.Request) {
+	m := make(map[string]rewriteStatus)
+	for from, to := range _rewrites.Load().(rewriteMap) {
+		s := rewriteStatus{To: to}
+		if hits, ok := _rewriteHits.Get(from).(*expvar.Int); ok {
+			s.Hits = hits.Value()
+		}
+		m[from] = s
+	}
+	writeJSON(w, m)
+}
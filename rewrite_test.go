@@ -0,0 +1,102 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestRewriteMap(t *testing.T) {
+	_reloadEvery = time.Millisecond * 20
+	dir, err := ioutil.TempDir("", "frontd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		os.RemoveAll(dir)
+		_rewrites.Store(rewriteMap{})
+		_reloadEvery = time.Second * 5
+	}()
+
+	// the retired server was merged into the echo server
+	retired := "127.0.0.1:62869"
+	path := filepath.Join(dir, "rewrites")
+	writeFileAtomic(t, path, retired+" "+string(_echoServerAddr)+"\n")
+	stop, err := loadAndWatch(path, loadRewriteMap)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stop()
+
+	b, err := encryptText([]byte(retired), _secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		conn, err := net.Dial("tcp", _defaultFrontdAddr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn.Write(append(b, '\n'))
+		testEchoRound(conn)
+		conn.Close()
+	}
+
+	w := httptest.NewRecorder()
+	serveAdminRewrites(w, httptest.NewRequest("GET", "/admin/rewrites", nil))
+	var status map[string]rewriteStatus
+	if err := json.Unmarshal(w.Body.Bytes(), &status); err != nil {
+		t.Fatal(err)
+	}
+	if s := status[retired]; s.To != string(_echoServerAddr) || s.Hits != 2 {
+		t.Fatalf("unexpected status %+v", status)
+	}
+
+	// the entry is removed once nobody hits it
+	writeFileAtomic(t, path, "# empty\n")
+	waitFor(t, "rewrite map not reloaded", func() bool { return rewriteTarget(retired) == retired })
+	testProtocol(append(b, '\n'), []byte("4102"))
+}
+
+func TestRewriteTargets(t *testing.T) {
+	defer func() {
+		_rewrites.Store(rewriteMap{})
+		_routes.Store(routeTable{})
+	}()
+	dir, err := ioutil.TempDir("", "frontd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "rewrites")
+	writeFileAtomic(t, path, "127.0.0.1:62869 "+string(_echoServerAddr)+"\n127.0.0.1:62867 zone-9\n")
+	if err := loadRewriteMap(path); err != nil {
+		t.Fatal(err)
+	}
+	_routes.Store(routeTable{"zone-9": string(_echoServerAddr)})
+
+	for target, expected := range map[string]string{
+		// the replacement is a route ID
+		"127.0.0.1:62867": string(_echoServerAddr),
+		// addresses of a list are rewritten one by one
+		"127.0.0.1:62869,127.0.0.1:62868?lb=first": string(_echoServerAddr) + ",127.0.0.1:62868?lb=first",
+		// but not by a route ID
+		"127.0.0.1:62867,127.0.0.1:62868": "127.0.0.1:62867,127.0.0.1:62868",
+	} {
+		if to := mapTarget(target, "127.0.0.1"); to != expected {
+			t.Fatalf("%s mapped to %s, expected %s", target, to, expected)
+		}
+	}
+
+	b, err := encryptText([]byte("127.0.0.1:62868,127.0.0.1:62869?lb=first"), _secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testProtocol(append(b, '\n'), nil)
+}
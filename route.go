@@ -0,0 +1,94 @@
+package main
+
+import (
+	"errors"
+	"expvar"
+	"fmt"
+	"net"
+	"net/http"
+	"sync/atomic"
+)
+
+var (
+	// path of the route table file, tokens may name a route of it instead of
+	// carrying the backend addresses
+	_RouteTable string
+
+	// routeTable, replaced as a whole on reload
+	_routes atomic.Value
+)
+
+// routeTable maps route IDs to targets
+type routeTable map[string]string
+
+func init() {
+	_routes.Store(routeTable{})
+	_metrics.Set("routes", expvar.Func(func() interface{} {
+		return len(_routes.Load().(routeTable))
+	}))
+	http.HandleFunc("/admin/routes", serveAdminRoutes)
+}
+
+// routeTarget returns the target of a route ID, anything else is returned
+// as is
+func routeTarget(s string) string {
+	if target, ok := _routes.Load().(routeTable)[s]; ok {
+		return target
+	}
+	return s
+}
+
+// loadRouteTable reads a route table and makes it the current one. Every
+// line holds a route ID and its target, e.g.
+//
+//	zone-3 10.0.0.1:9000,10.0.0.2:9000?lb=hash
+func loadRouteTable(path string) error {
+	routes, err := readTargetFile(path, false)
+	if err != nil {
+		return err
+	}
+	_routes.Store(routeTable(routes))
+	return nil
+}
+
+// checkTarget validates a target of a file, which may be a route ID unless
+// the file is the route table itself
+func checkTarget(target string, routeID bool) error {
+	if isMultiTarget(target) {
+		_, err := parseBackendTarget(target)
+		return err
+	}
+	if routeID {
+		return nil
+	}
+	_, _, err := net.SplitHostPort(target)
+	return err
+}
+
+// readTargetFile reads a file mapping keys to targets, one pair per line.
+// Empty lines and lines starting with # are skipped.
+func readTargetFile(path string, routeID bool) (map[string]string, error) {
+	m := make(map[string]string)
+	err := readConfigLines(path, func(fields []string) error {
+		if len(fields) != 2 {
+			return errors.New("expected a key and its target")
+		}
+		key, target := fields[0], fields[1]
+		if _, ok := m[key]; ok {
+			return fmt.Errorf("duplicated key %q", key)
+		}
+		if err := checkTarget(target, routeID); err != nil {
+			return err
+		}
+		m[key] = target
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func serveAdminRoutes(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, _routes.Load().(routeTable))
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"errors"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// writeFileAtomic replaces a file the way deployments should
+func writeFileAtomic(t *testing.T, path, content string) {
+	tmp := path + ".tmp"
+	if err := ioutil.WriteFile(tmp, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// waitFor polls cond for up to a second
+func waitFor(t *testing.T, what string, cond func() bool) {
+	for i := 0; !cond(); i++ {
+		if i > 100 {
+			t.Fatal(what)
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+}
+
+func TestRouteTable(t *testing.T) {
+	_reloadEvery = time.Millisecond * 20
+	dir, err := ioutil.TempDir("", "frontd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		os.RemoveAll(dir)
+		_routes.Store(routeTable{})
+		_reloadEvery = time.Second * 5
+	}()
+
+	path := filepath.Join(dir, "routes")
+	writeFileAtomic(t, path, "# game gateways\n\nzone-1 127.0.0.1:62868,"+string(_echoServerAddr)+"?lb=first\n")
+	stop, err := loadAndWatch(path, loadRouteTable)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stop()
+
+	b, err := encryptText([]byte("zone-1"), _secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := net.Dial("tcp", _defaultFrontdAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Write(append(b, '\n'))
+	testEchoRound(conn)
+	conn.Close()
+
+	// the server moved
+	writeFileAtomic(t, path, "zone-1 127.0.0.1:62868\n")
+	waitFor(t, "route table not reloaded", func() bool { return routeTarget("zone-1") == "127.0.0.1:62868" })
+	testProtocol(append(b, '\n'), []byte("4102"))
+
+	// a bad edit keeps the last good table
+	failed := metricValue("reload_errors")
+	writeFileAtomic(t, path, "zone-1\n")
+	waitFor(t, "bad route table not reported", func() bool { return metricValue("reload_errors") > failed })
+	if routeTarget("zone-1") != "127.0.0.1:62868" {
+		t.Fatal("bad route table loaded")
+	}
+}
+
+func TestLoadRouteTableErrors(t *testing.T) {
+	dir, err := ioutil.TempDir("", "frontd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	defer _routes.Store(routeTable{})
+
+	path := filepath.Join(dir, "routes")
+	for _, content := range []string{
+		"a 10.0.0.1:9000 10.0.0.2:9000",
+		"a 10.0.0.1:9000\na 10.0.0.2:9000",
+		"a 10.0.0.1",
+		"a 10.0.0.1:9000?lb=x",
+		"a unknown://b",
+	} {
+		writeFileAtomic(t, path, content)
+		if err := loadRouteTable(path); err == nil {
+			t.Errorf("%q should not load", content)
+		}
+	}
+}
+
+func TestReadConfigLines(t *testing.T) {
+	dir, err := ioutil.TempDir("", "frontd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "conf")
+	writeFileAtomic(t, path, "# comment\n\n  a  b \nc\n")
+	var lines [][]string
+	err = readConfigLines(path, func(fields []string) error {
+		lines = append(lines, fields)
+		if len(fields) != 2 {
+			return errors.New("bad line")
+		}
+		return nil
+	})
+	if err == nil || err.Error() != path+":4: bad line" {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if len(lines) != 2 || lines[0][0] != "a" || lines[0][1] != "b" {
+		t.Fatalf("unexpected lines %q", lines)
+	}
+}
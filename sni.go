@@ -0,0 +1,120 @@
+package main
+
+import (
+	"bufio"
+	"encoding/base32"
+	"encoding/binary"
+	"errors"
+	"strings"
+)
+
+// cipher addresses in SNI hostnames are lower case base32 without padding,
+// split into labels of at most 63 characters
+var _sniEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// sniCipherAddr decrypts the backend address encoded in the labels of a
+// server name in front of domain. It returns nil if the server name is not
+// under domain.
+func sniCipherAddr(serverName, domain string) ([]byte, error) {
+	suffix := "." + domain
+	if !strings.HasSuffix(strings.ToLower(serverName), suffix) {
+		return nil, nil
+	}
+	label := strings.Replace(serverName[:len(serverName)-len(suffix)], ".", "", -1)
+
+	key, err := _sniEncoding.DecodeString(strings.ToUpper(label))
+	if err != nil {
+		return nil, err
+	}
+	return backendAddrDecrypt(key)
+}
+
+// peekServerName returns the server_name extension of the ClientHello in the
+// first TLS record, which has to fit into the reader's buffer. Nothing is
+// consumed, so the handshake can still be passed on or terminated.
+func peekServerName(rdr *bufio.Reader) (string, error) {
+	hdr, err := rdr.Peek(5)
+	if err != nil {
+		return "", err
+	}
+	record, err := rdr.Peek(5 + int(binary.BigEndian.Uint16(hdr[3:])))
+	if err != nil {
+		return "", err
+	}
+
+	// handshake type and length
+	b := record[5:]
+	if len(b) < 4 || b[0] != 0x01 {
+		return "", errors.New("tls record is not a ClientHello")
+	}
+	b = b[4:]
+
+	// client_version, random
+	if len(b) < 34 {
+		return "", errors.New("short ClientHello")
+	}
+	b = b[34:]
+
+	// session_id, cipher_suites, compression_methods
+	var ok bool
+	if b, ok = skipVector(b, 1); !ok {
+		return "", errors.New("short ClientHello")
+	}
+	if b, ok = skipVector(b, 2); !ok {
+		return "", errors.New("short ClientHello")
+	}
+	if b, ok = skipVector(b, 1); !ok {
+		return "", errors.New("short ClientHello")
+	}
+
+	if len(b) < 2 {
+		return "", nil
+	}
+	b = b[2:]
+	for len(b) >= 4 {
+		typ := binary.BigEndian.Uint16(b)
+		n := int(binary.BigEndian.Uint16(b[2:]))
+		b = b[4:]
+		if len(b) < n {
+			break
+		}
+		if typ != 0 {
+			b = b[n:]
+			continue
+		}
+
+		// server_name_list
+		names := b[:n]
+		if len(names) < 2 {
+			break
+		}
+		names = names[2:]
+		for len(names) >= 3 {
+			l := int(binary.BigEndian.Uint16(names[1:]))
+			if len(names) < 3+l {
+				break
+			}
+			if names[0] == 0 {
+				return string(names[3 : 3+l]), nil
+			}
+			names = names[3+l:]
+		}
+		break
+	}
+	return "", nil
+}
+
+// skipVector skips a TLS vector with a length prefix of n bytes
+func skipVector(b []byte, n int) ([]byte, bool) {
+	if len(b) < n {
+		return nil, false
+	}
+	l := 0
+	for _, c := range b[:n] {
+		l = l<<8 | int(c)
+	}
+	if len(b) < n+l {
+		return nil, false
+	}
+	return b[n+l:], true
+}
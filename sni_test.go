@@ -0,0 +1,104 @@
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/xindong/frontd/aes256cbc"
+)
+
+func sniServerName(addr []byte) string {
+	b, err := aes256cbc.New().Encrypt(_secret, addr)
+	if err != nil {
+		panic(err)
+	}
+	label := strings.ToLower(_sniEncoding.EncodeToString(b))
+
+	var labels []string
+	for len(label) > 63 {
+		labels = append(labels, label[:63])
+		label = label[63:]
+	}
+	labels = append(labels, label)
+	return strings.Join(labels, ".") + ".gw.example.com"
+}
+
+func TestSNIPassthrough(t *testing.T) {
+	frontd, stop := startListener(t, &listener{sniDomain: "gw.example.com"})
+	defer stop()
+
+	s := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "backend %s", r.Host)
+	}))
+	defer s.Close()
+
+	for _, addr := range []string{
+		strings.TrimPrefix(s.URL, "https://"),
+		// long enough to span two labels
+		"localhost.localdomain.example:" + s.URL[strings.LastIndex(s.URL, ":")+1:],
+	} {
+		serverName := sniServerName([]byte(addr))
+		if strings.HasPrefix(addr, "localhost") {
+			if strings.Count(serverName, ".") < 4 {
+				t.Fatalf("expected several labels in %s", serverName)
+			}
+			// can not be dialed, just check the routing
+			conn, err := tls.Dial("tcp", frontd, &tls.Config{ServerName: serverName, InsecureSkipVerify: true})
+			if err == nil {
+				conn.Close()
+				t.Fatal("unexpected handshake with unknown backend")
+			}
+			continue
+		}
+
+		// frontd does not terminate TLS, the backend certificate is seen
+		conn, err := tls.Dial("tcp", frontd, &tls.Config{ServerName: serverName, InsecureSkipVerify: true})
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn.SetDeadline(time.Now().Add(time.Second * 5))
+		if !conn.ConnectionState().PeerCertificates[0].Equal(s.Certificate()) {
+			t.Fatal("handshake not with the backend")
+		}
+		fmt.Fprintf(conn, "GET / HTTP/1.0\r\nHost: %s\r\n\r\n", serverName)
+		b, err := ioutil.ReadAll(conn)
+		conn.Close()
+		if !strings.HasSuffix(string(b), "backend "+serverName) {
+			t.Fatalf("unexpected reply %q (%v)", b, err)
+		}
+	}
+
+	// a server name which fails to decrypt counts like any other cipher
+	// address
+	failures := metricValue("decrypt_failures")
+	conn, err := tls.Dial("tcp", frontd, &tls.Config{ServerName: "mjf3mje.gw.example.com", InsecureSkipVerify: true})
+	if err == nil {
+		conn.Close()
+		t.Fatal("unexpected handshake with a bad server name")
+	}
+	if metricValue("decrypt_failures") != failures+1 {
+		t.Fatal("decrypt failure not counted")
+	}
+
+	// server names outside SNI_DOMAIN are not routed without a certificate
+	conn, err = tls.Dial("tcp", frontd, &tls.Config{ServerName: "example.com", InsecureSkipVerify: true})
+	if err == nil {
+		conn.Close()
+		t.Fatal("unexpected handshake")
+	}
+
+	// but terminated with one
+	frontd, stop = startListener(t, &listener{sniDomain: "gw.example.com", tlsConfig: testTLSConfig()})
+	defer stop()
+	conn, err = tls.Dial("tcp", frontd, &tls.Config{ServerName: "example.com", InsecureSkipVerify: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+}
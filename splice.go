@@ -0,0 +1,63 @@
+package main
+
+import (
+	"bufio"
+	"io"
+	"net"
+)
+
+// relay with splice(2) where available, see splice_linux.go
+var _Splice = true
+
+// tcpConnOf unwraps the connections frontd wraps around a *net.TCPConn
+func tcpConnOf(c net.Conn) *net.TCPConn {
+	for {
+		switch cc := c.(type) {
+		case *net.TCPConn:
+			return cc
+		case *backendConn:
+			c = cc.Conn
+		case *proxyConn:
+			c = cc.Conn
+		case *clientConn:
+			c = cc.Conn
+		default:
+			return nil
+		}
+	}
+}
+
+// splicePipe relays src to dst like pipe does when both connections are
+// plain TCP and the kernel can move the bytes itself. src is the source
+// connection, or a bufio.Reader on top of it which is drained first. It
+// reports false if it did not relay anything, so pipe has to, and returns
+// nil at EOF otherwise.
+func splicePipe(dst io.Writer, src io.Reader, dstconn, srcconn net.Conn, h *halfClose) (bool, error) {
+	if dst != dstconn {
+		return false, nil
+	}
+	dtcp, stcp := tcpConnOf(dstconn), tcpConnOf(srcconn)
+	if dtcp == nil || stcp == nil {
+		return false, nil
+	}
+	switch s := src.(type) {
+	case net.Conn:
+		if s != srcconn {
+			return false, nil
+		}
+	case *bufio.Reader:
+	default:
+		return false, nil
+	}
+	if !spliceSupported() {
+		return false, nil
+	}
+
+	if rdr, ok := src.(*bufio.Reader); ok {
+		if err := flushBuffered(dst, rdr); err != nil {
+			return true, err
+		}
+	}
+	countMetric("relay_spliced")
+	return true, spliceTCP(dtcp, stcp, srcconn, h)
+}
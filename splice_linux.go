@@ -0,0 +1,130 @@
+//go:build linux
+// +build linux
+
+package main
+
+import (
+	"net"
+	"runtime"
+	"sync"
+	"syscall"
+	"time"
+)
+
+const (
+	spliceMove     = 0x1
+	spliceNonblock = 0x2
+
+	// the default capacity of a pipe
+	_spliceSize = 64 << 10
+)
+
+// kernelPipes holds empty pipes, so idle connections hold none
+var _kernelPipes = sync.Pool{New: func() interface{} {
+	var p [2]int
+	if err := syscall.Pipe2(p[:], syscall.O_CLOEXEC|syscall.O_NONBLOCK); err != nil {
+		return nil
+	}
+	kp := &kernelPipe{r: p[0], w: p[1]}
+	runtime.SetFinalizer(kp, (*kernelPipe).close)
+	return kp
+}}
+
+type kernelPipe struct {
+	r, w int
+}
+
+func (p *kernelPipe) close() {
+	runtime.SetFinalizer(p, nil)
+	syscall.Close(p.r)
+	syscall.Close(p.w)
+}
+
+func spliceSupported() bool {
+	return true
+}
+
+// spliceTCP moves the bytes from src to dst through a pipe without copying
+// them to user space. Waiting for the sockets is left to the runtime poller,
+// so deadlines work as they do for reads. It returns nil at EOF.
+func spliceTCP(dst, src *net.TCPConn, srcconn net.Conn, h *halfClose) error {
+	rc, err := src.SyscallConn()
+	if err != nil {
+		return err
+	}
+	wc, err := dst.SyscallConn()
+	if err != nil {
+		return err
+	}
+
+	last := time.Now()
+	for {
+		srcconn.SetReadDeadline(h.readDeadline())
+		err := waitTCPReadable(src)
+		if neterr, ok := err.(net.Error); ok && neterr.Timeout() && !h.expired(last) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+
+		p, _ := _kernelPipes.Get().(*kernelPipe)
+		if p == nil {
+			countMetric("relay_splice_errors")
+			return pipeCopy(dst, src, srcconn, h)
+		}
+		n, err := spliceOnce(wc, rc, p)
+		if err != nil {
+			// it may not be empty
+			p.close()
+			return err
+		}
+		_kernelPipes.Put(p)
+		if n == 0 {
+			// EOF
+			return nil
+		}
+		last = time.Now()
+	}
+}
+
+// spliceOnce moves what src has into the pipe and on to dst
+func spliceOnce(dst, src syscall.RawConn, p *kernelPipe) (int, error) {
+	var n int
+	var serr error
+	err := src.Read(func(fd uintptr) bool {
+		n, serr = spliceRetry(int(fd), p.w, _spliceSize)
+		return serr != syscall.EAGAIN
+	})
+	if err == nil {
+		err = serr
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	for left := n; left > 0; {
+		var m int
+		err := dst.Write(func(fd uintptr) bool {
+			m, serr = spliceRetry(p.r, int(fd), left)
+			return serr != syscall.EAGAIN
+		})
+		if err == nil {
+			err = serr
+		}
+		if err != nil {
+			return 0, err
+		}
+		left -= m
+	}
+	return n, nil
+}
+
+func spliceRetry(rfd, wfd, n int) (int, error) {
+	for {
+		m, err := syscall.Splice(rfd, nil, wfd, nil, n, spliceMove|spliceNonblock)
+		if err != syscall.EINTR {
+			return int(m), err
+		}
+	}
+}
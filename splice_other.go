@@ -0,0 +1,14 @@
+//go:build !linux
+// +build !linux
+
+package main
+
+import "net"
+
+func spliceSupported() bool {
+	return false
+}
+
+func spliceTCP(dst, src *net.TCPConn, srcconn net.Conn, h *halfClose) error {
+	return pipeCopy(dst, src, srcconn, h)
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"io"
+	"io/ioutil"
+	"net"
+	"testing"
+	"time"
+)
+
+// tcpPair returns both ends of a TCP connection
+func tcpPair() (net.Conn, net.Conn) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		panic(err)
+	}
+	defer l.Close()
+	c, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		panic(err)
+	}
+	s, err := l.Accept()
+	if err != nil {
+		panic(err)
+	}
+	return c, s
+}
+
+// relayPair relays what is written to the first connection returned to the
+// second one with pipe
+func relayPair(splice bool) (net.Conn, net.Conn) {
+	in, src := tcpPair()
+	dst, out := tcpPair()
+	go pipe(dst, src, dst, src, &halfClose{timeout: time.Minute}, splice)
+	return in, out
+}
+
+func TestSplice(t *testing.T) {
+	data := make([]byte, 4<<20)
+	rand.Read(data)
+	for _, splice := range []bool{true, false} {
+		spliced := metricValue("relay_spliced")
+
+		in, out := relayPair(splice)
+		go func() {
+			in.Write(data)
+			in.Close()
+		}()
+		got, err := ioutil.ReadAll(out)
+		out.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, data) {
+			t.Fatalf("splice %v: %d bytes relayed, corrupted", splice, len(got))
+		}
+		if n := metricValue("relay_spliced") - spliced; splice != (n == 1) {
+			t.Fatalf("splice %v: %d relays spliced", splice, n)
+		}
+	}
+}
+
+func TestSpliceBuffered(t *testing.T) {
+	in, src := tcpPair()
+	dst, out := tcpPair()
+	defer in.Close()
+	defer out.Close()
+
+	// a handshake was read ahead along with the first bytes of the stream
+	in.Write([]byte("hello\nworld"))
+	rdr := bufio.NewReader(src)
+	if line, _ := rdr.ReadString('\n'); line != "hello\n" {
+		t.Fatalf("unexpected line %q", line)
+	}
+	spliced := metricValue("relay_spliced")
+	go pipe(dst, rdr, dst, src, &halfClose{timeout: time.Minute}, true)
+
+	in.Write([]byte(", spliced"))
+	buf := make([]byte, len("world, spliced"))
+	if _, err := io.ReadFull(out, buf); err != nil {
+		t.Fatal(err)
+	}
+	if string(buf) != "world, spliced" {
+		t.Fatalf("unexpected %q", buf)
+	}
+	if metricValue("relay_spliced") != spliced+1 {
+		t.Fatal("not spliced")
+	}
+
+	// wrapped by frontd
+	if tcpConnOf(&backendConn{&proxyConn{Conn: src}, func() {}}) == nil {
+		t.Fatal("backend connection not unwrapped")
+	}
+}
+
+func benchmarkRelay(b *testing.B, splice bool) {
+	in, out := relayPair(splice)
+	defer in.Close()
+	defer out.Close()
+	go io.Copy(ioutil.Discard, out)
+
+	buf := make([]byte, 64<<10)
+	b.SetBytes(int64(len(buf)))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := in.Write(buf); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkRelaySplice(b *testing.B) {
+	benchmarkRelay(b, true)
+}
+
+func BenchmarkRelayCopy(b *testing.B) {
+	benchmarkRelay(b, false)
+}
@@ -0,0 +1,352 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"strings"
+	"sync"
+)
+
+// a WebSocket subprotocol carrying the cipher address looks like
+// "x-cipher-origin.<url-safe base64>"
+var _wsCipherProtocolPrefix = string(_hdrCipherOrigin) + "."
+
+// websocketCipher looks for the cipher address of a WebSocket handshake in
+// the x-cipher-origin query parameter, the Sec-WebSocket-Protocol list or the
+// first path segment, in that order. It returns the request target and the
+// protocol list with the cipher address taken out, along with the protocol
+// entry which carried it, if any.
+func websocketCipher(target, protocols string) (cipherAddr []byte, newTarget, newProtocols, wsProtocol string) {
+	newTarget, newProtocols = target, protocols
+
+	path, query := target, ""
+	if i := strings.Index(target, "?"); i >= 0 {
+		path, query = target[:i], target[i+1:]
+	}
+
+	// query string
+	if len(query) > 0 {
+		params := strings.Split(query, "&")
+		for i, p := range params {
+			if !strings.HasPrefix(p, string(_hdrCipherOrigin)+"=") {
+				continue
+			}
+			v, err := url.QueryUnescape(p[len(_hdrCipherOrigin)+1:])
+			if err != nil {
+				return nil, target, protocols, ""
+			}
+			// an unescaped '+' of standard base64 turns into a space
+			cipherAddr = []byte(strings.Replace(v, " ", "+", -1))
+
+			params = append(params[:i], params[i+1:]...)
+			newTarget = path
+			if len(params) > 0 {
+				newTarget += "?" + strings.Join(params, "&")
+			}
+			return
+		}
+	}
+
+	// subprotocol
+	if len(protocols) > 0 {
+		list := strings.Split(protocols, ",")
+		for i, p := range list {
+			p = strings.TrimSpace(p)
+			if !strings.HasPrefix(p, _wsCipherProtocolPrefix) {
+				continue
+			}
+			cipherAddr = []byte(p[len(_wsCipherProtocolPrefix):])
+			wsProtocol = p
+
+			list = append(list[:i], list[i+1:]...)
+			for j := range list {
+				list[j] = strings.TrimSpace(list[j])
+			}
+			newProtocols = strings.Join(list, ", ")
+			return
+		}
+	}
+
+	// first path segment
+	segments := strings.SplitN(strings.TrimPrefix(path, "/"), "/", 2)
+	if len(segments[0]) > 0 {
+		v, err := url.PathUnescape(segments[0])
+		if err != nil {
+			return nil, target, protocols, ""
+		}
+		cipherAddr = []byte(v)
+
+		newTarget = "/"
+		if len(segments) > 1 {
+			newTarget += segments[1]
+		}
+		if len(query) > 0 {
+			newTarget += "?" + query
+		}
+	}
+	return
+}
+
+// relayWebSocketHandshake copies the backend reply of a WebSocket handshake
+// to the client. A client offering subprotocols fails the handshake unless
+// one is selected, so the protocol that carried the cipher address is
+// selected if the backend did not pick any.
+func relayWebSocketHandshake(rdr *bufio.Reader, c net.Conn, wsProtocol string) error {
+	var reply bytes.Buffer
+	var switching, selected bool
+	for first := true; ; first = false {
+		line, isPrefix, err := rdr.ReadLine()
+		if err != nil {
+			return err
+		}
+		if isPrefix {
+			return errors.New("websocket handshake reply line too long")
+		}
+
+		if first {
+			fields := bytes.Fields(line)
+			switching = len(fields) > 1 && bytes.Equal(fields[1], []byte("101"))
+		}
+		if bytes.HasPrefix(bytes.ToLower(line), _hdrWebSocketProtocol) {
+			selected = true
+		}
+
+		if len(bytes.TrimSpace(line)) == 0 {
+			if switching && !selected {
+				reply.WriteString("Sec-WebSocket-Protocol: " + wsProtocol + "\r\n")
+			}
+			reply.WriteString("\r\n")
+			break
+		}
+		reply.Write(line)
+		reply.WriteString("\r\n")
+
+		if reply.Len() > _maxHTTPHeaderSize {
+			return errors.New("websocket handshake reply size overflowed")
+		}
+	}
+
+	_, err := reply.WriteTo(c)
+	return err
+}
+
+// isWebSocketBridge tells if a WebSocket handshake for target should be
+// terminated and bridged to a TCP backend, as it is for path
+func isWebSocketBridge(target, path string) bool {
+	if len(path) == 0 {
+		return false
+	}
+	if i := strings.Index(target, "?"); i >= 0 {
+		target = target[:i]
+	}
+	return target == path
+}
+
+// bridgeWebSocket completes the WebSocket handshake itself, then tunnels the
+// payload of the WebSocket frames to a plain TCP backend. The backend is
+// dialed first, so a failure is answered with an HTTP error.
+func bridgeWebSocket(addr string, rdr *bufio.Reader, c net.Conn, wsKey, wsProtocol string, relay *relayConfig, backends *backendTable) error {
+	if len(wsKey) == 0 {
+		writeErrCode(c, []byte("4107"), true)
+		return errors.New("websocket handshake without key")
+	}
+	backend, errCode, err := backends.dialTarget(addr, ipAddrFromRemoteAddr(c.RemoteAddr().String()))
+	if err != nil {
+		writeErrCode(c, errCode, true)
+		return err
+	}
+
+	h := sha1.New()
+	h.Write([]byte(wsKey + _wsAcceptGUID))
+	reply := "HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n" +
+		"Sec-WebSocket-Accept: " + base64.StdEncoding.EncodeToString(h.Sum(nil)) + "\r\n"
+	if len(wsProtocol) > 0 {
+		reply += "Sec-WebSocket-Protocol: " + wsProtocol + "\r\n"
+	}
+	if _, err := c.Write([]byte(reply + "\r\n")); err != nil {
+		backend.Close()
+		return err
+	}
+
+	ws := &wsConn{Conn: c, rdr: rdr}
+	return tunnel(backend, bufio.NewReader(ws), func() {}, ws, nil, relay)
+}
+
+const _wsAcceptGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+// WebSocket opcodes
+const (
+	_wsOpContinuation = 0x0
+	_wsOpText         = 0x1
+	_wsOpBinary       = 0x2
+	_wsOpClose        = 0x8
+	_wsOpPing         = 0x9
+	_wsOpPong         = 0xa
+)
+
+// wsConn is the server side of a WebSocket connection. Reads return the
+// payload of data frames, writes are sent as binary frames.
+type wsConn struct {
+	net.Conn
+	rdr *bufio.Reader
+
+	// payload left in the current data frame and its masking key
+	remaining int64
+	mask      [4]byte
+	maskPos   int
+
+	wmu    sync.Mutex
+	closed bool
+}
+
+// readFrameHeader reads the next frame header, along with the payload of
+// control frames. It peeks until the frame is complete so a read timeout does
+// not lose part of it.
+func (ws *wsConn) readFrameHeader() (opcode byte, length int64, payload []byte, err error) {
+	b, err := ws.rdr.Peek(2)
+	if err != nil {
+		return 0, 0, nil, err
+	}
+	if b[1]&0x80 == 0 {
+		return 0, 0, nil, errors.New("websocket client frame not masked")
+	}
+	// no extension is negotiated
+	if b[0]&0x70 != 0 {
+		return 0, 0, nil, errors.New("websocket frame with reserved bits set")
+	}
+	opcode = b[0] & 0x0f
+	switch opcode {
+	case _wsOpContinuation, _wsOpText, _wsOpBinary:
+	case _wsOpClose, _wsOpPing, _wsOpPong:
+		if b[0]&0x80 == 0 {
+			return 0, 0, nil, errors.New("fragmented websocket control frame")
+		}
+	default:
+		return 0, 0, nil, fmt.Errorf("unknown websocket opcode %#x", opcode)
+	}
+
+	hlen := 2 + 4
+	switch b[1] & 0x7f {
+	case 126:
+		hlen += 2
+	case 127:
+		hlen += 8
+	}
+	b, err = ws.rdr.Peek(hlen)
+	if err != nil {
+		return 0, 0, nil, err
+	}
+
+	switch b[1] & 0x7f {
+	case 126:
+		length = int64(binary.BigEndian.Uint16(b[2:]))
+	case 127:
+		length = int64(binary.BigEndian.Uint64(b[2:]))
+		if length < 0 {
+			return 0, 0, nil, errors.New("websocket frame too large")
+		}
+	default:
+		length = int64(b[1] & 0x7f)
+	}
+	copy(ws.mask[:], b[hlen-4:])
+	ws.maskPos = 0
+
+	if opcode >= _wsOpClose {
+		if length > 125 {
+			return 0, 0, nil, errors.New("websocket control frame too large")
+		}
+		b, err = ws.rdr.Peek(hlen + int(length))
+		if err != nil {
+			return 0, 0, nil, err
+		}
+		payload = append([]byte{}, b[hlen:]...)
+		ws.unmask(payload)
+		hlen += int(length)
+	}
+
+	ws.rdr.Discard(hlen)
+	return opcode, length, payload, nil
+}
+
+func (ws *wsConn) Read(p []byte) (int, error) {
+	for ws.remaining == 0 {
+		opcode, length, payload, err := ws.readFrameHeader()
+		if err != nil {
+			return 0, err
+		}
+
+		switch opcode {
+		case _wsOpContinuation, _wsOpText, _wsOpBinary:
+			ws.remaining = length
+		case _wsOpClose:
+			return 0, io.EOF
+		case _wsOpPing:
+			ws.writeFrame(_wsOpPong, payload)
+		}
+	}
+
+	if int64(len(p)) > ws.remaining {
+		p = p[:ws.remaining]
+	}
+	n, err := ws.rdr.Read(p)
+	ws.unmask(p[:n])
+	ws.remaining -= int64(n)
+	return n, err
+}
+
+func (ws *wsConn) unmask(p []byte) {
+	for i := range p {
+		p[i] ^= ws.mask[ws.maskPos&3]
+		ws.maskPos++
+	}
+}
+
+func (ws *wsConn) Write(p []byte) (int, error) {
+	if err := ws.writeFrame(_wsOpBinary, p); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+func (ws *wsConn) writeFrame(opcode byte, payload []byte) error {
+	ws.wmu.Lock()
+	defer ws.wmu.Unlock()
+	if ws.closed {
+		return errors.New("websocket closed")
+	}
+
+	frame := make([]byte, 0, len(payload)+10)
+	frame = append(frame, 0x80|opcode)
+	switch {
+	case len(payload) < 126:
+		frame = append(frame, byte(len(payload)))
+	case len(payload) <= 0xffff:
+		frame = append(frame, 126, byte(len(payload)>>8), byte(len(payload)))
+	default:
+		frame = append(frame, 127)
+		frame = append(frame, make([]byte, 8)...)
+		binary.BigEndian.PutUint64(frame[2:], uint64(len(payload)))
+	}
+	frame = append(frame, payload...)
+
+	_, err := ws.Conn.Write(frame)
+	return err
+}
+
+// Close sends a close frame before closing the connection
+func (ws *wsConn) Close() error {
+	ws.writeFrame(_wsOpClose, []byte{0x03, 0xe8})
+
+	ws.wmu.Lock()
+	ws.closed = true
+	ws.wmu.Unlock()
+	return ws.Conn.Close()
+}
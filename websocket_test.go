@@ -0,0 +1,121 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"testing"
+	"time"
+
+	"golang.org/x/net/websocket"
+)
+
+func dialWebSocketBridge(t *testing.T, frontd string, backend []byte) *websocket.Conn {
+	cipherAddr, err := encryptText(backend, _secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ws, err := websocket.Dial("ws://"+frontd+"/tcp?x-cipher-origin="+url.QueryEscape(string(cipherAddr)),
+		"", "http://127.0.0.1/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ws.SetDeadline(time.Now().Add(time.Second * 5))
+	return ws
+}
+
+func TestWebSocketBridge(t *testing.T) {
+	for _, perRequest := range []bool{false, true} {
+		frontd, stop := startListener(t, &listener{wsBridgePath: "/tcp", httpPerRequest: perRequest})
+		defer stop()
+
+		ws := dialWebSocketBridge(t, frontd, _echoServerAddr)
+		ws.PayloadType = websocket.BinaryFrame
+
+		// larger than a single read from the echo server
+		out := randomBytes(70000)
+		if _, err := ws.Write(out); err != nil {
+			t.Fatal(err)
+		}
+		in := make([]byte, len(out))
+		if _, err := io.ReadFull(ws, in); err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(out, in) {
+			t.Fatal("websocket bridge reply not match")
+		}
+		ws.Close()
+	}
+}
+
+// rawWebSocketBridge sends the handshake of the WebSocket bridge to backend
+// through frontd, returning the connection and what frontd replied
+func rawWebSocketBridge(t *testing.T, frontd string, backend []byte) (net.Conn, *bufio.Reader, *http.Response) {
+	cipherAddr, err := encryptText(backend, _secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := net.Dial("tcp", frontd)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.SetDeadline(time.Now().Add(time.Second * 5))
+	fmt.Fprintf(conn, "GET /tcp?x-cipher-origin=%s HTTP/1.1\r\nHost: a\r\nUpgrade: websocket\r\n"+
+		"Connection: Upgrade\r\nSec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==\r\nSec-WebSocket-Version: 13\r\n\r\n",
+		url.QueryEscape(string(cipherAddr)))
+	rdr := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(rdr, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return conn, rdr, resp
+}
+
+func TestWebSocketBridgeBackendError(t *testing.T) {
+	frontd, stop := startListener(t, &listener{wsBridgePath: "/tcp"})
+	defer stop()
+
+	// not upgraded, the dial failure is an HTTP error
+	conn, _, resp := rawWebSocketBridge(t, frontd, _blackHoleServerAddr)
+	defer conn.Close()
+	body, _ := ioutil.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusBadGateway || string(body) != "4102" {
+		t.Fatalf("expected 502 4102, got %d %q", resp.StatusCode, body)
+	}
+}
+
+func TestWebSocketBridgeBadFrame(t *testing.T) {
+	frontd, stop := startListener(t, &listener{wsBridgePath: "/tcp"})
+	defer stop()
+
+	for _, header := range [][]byte{
+		// RSV1 set
+		{0xc2, 0x84},
+		// opcode 0x3 is reserved
+		{0x83, 0x84},
+		// fragmented ping
+		{0x09, 0x84},
+	} {
+		conn, rdr, resp := rawWebSocketBridge(t, frontd, _echoServerAddr)
+		if resp.StatusCode != http.StatusSwitchingProtocols {
+			t.Fatalf("unexpected status %d", resp.StatusCode)
+		}
+		conn.Write(append(header, 0, 0, 0, 0, 'p', 'i', 'n', 'g'))
+
+		// closed without echoing the payload
+		b, err := ioutil.ReadAll(rdr)
+		conn.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if bytes.Contains(b, []byte("ping")) {
+			t.Fatalf("frame %x relayed", header)
+		}
+	}
+}